@@ -27,23 +27,65 @@ func main() {
 	profileCache := flag.String("profile-cache", ".fhir-cache", "Directory for StructureDefinition cache")
 	profileCacheTTL := flag.Duration("profile-cache-ttl", 24*time.Hour, "Cache TTL for StructureDefinitions")
 	profileCacheVersion := flag.Int("profile-cache-version", validation.CacheVersion, "Cache version for StructureDefinitions")
+	storeDir := flag.String("store-dir", "", "Directory for the on-disk store (in-memory when empty)")
+	storeSnapshotEvery := flag.Int("store-snapshot-every", store.DefaultSnapshotEvery, "Writes between on-disk store snapshots")
+	snapshotDir := flag.String("snapshot-dir", ".fhir-snapshots", "Directory for on-disk admin snapshots")
+	idMode := flag.String("id-mode", "uuid", "Id assignment for create: uuid or sequence")
+	includeDepth := flag.Int("include-depth", search.DefaultIncludeDepth, "Maximum rounds followed by _include:iterate and _revinclude:iterate")
+	pageSize := flag.Int("page-size", search.DefaultPageSize, "Search page size when _count is absent")
+	maxPageSize := flag.Int("max-page-size", search.DefaultMaxPageSize, "Largest search page a client may request with _count")
+	profileFetch := flag.Bool("profile-fetch", false, "Fetch StructureDefinitions from hl7.org instead of using the embedded copies")
 	flag.Parse()
 
 	if *fhirVersion != "dstu3" {
 		log.Fatalf("unsupported fhir-version: %s", *fhirVersion)
 	}
 
+	var ids api.Option
+	switch *idMode {
+	case "uuid":
+		ids = api.WithIDGenerator(store.UUIDGenerator())
+	case "sequence":
+		ids = api.WithSequenceIDs()
+	default:
+		log.Fatalf("unsupported id-mode: %s", *idMode)
+	}
+
 	registry := dstu3.NewRegistry()
 	profileStore := validation.NewProfileStore(*profileCache, *profileCacheTTL, *profileCacheVersion)
 	if err := profileStore.LoadDefaults(context.Background(), registry); err != nil {
 		log.Fatalf("profile load failed: %v", err)
 	}
+	if *profileFetch {
+		if err := profileStore.LoadRemote(context.Background(), registry); err != nil {
+			log.Printf("profile fetch failed, using embedded definitions: %v", err)
+		}
+	}
 	validator := validation.NewValidator(registry, profileStore)
-	store := store.NewStore()
-	searcher := search.NewSearcher(registry, store)
+	clock := store.NewAdjustableClock()
+	var resourceStore store.Store
+	if *storeDir != "" {
+		fileStore, err := store.OpenFileStore(*storeDir, registry, *storeSnapshotEvery)
+		if err != nil {
+			log.Fatalf("store open failed: %v", err)
+		}
+		fileStore.SetClock(clock)
+		defer func() {
+			if err := fileStore.Close(); err != nil {
+				log.Printf("store close error: %v", err)
+			}
+		}()
+		resourceStore = fileStore
+	} else {
+		memoryStore := store.NewMemoryStore()
+		memoryStore.SetClock(clock)
+		resourceStore = memoryStore
+	}
+	searcher := search.NewSearcher(registry, resourceStore, search.WithIncludeDepth(*includeDepth), search.WithPageSize(*pageSize, *maxPageSize))
+	validator.AddCheck("SearchParameter", searcher.CheckSearchParameter)
 
 	if *seedGlob != "" {
-		if err := api.LoadSeed(*seedGlob, *seedStrict, registry, validator, store); err != nil {
+		if err := api.LoadSeed(*seedGlob, *seedStrict, registry, validator, resourceStore); err != nil {
 			log.Fatalf("seed load failed: %v", err)
 		}
 	}
@@ -53,7 +95,7 @@ func main() {
 	e.HideBanner = true
 	e.HidePort = true
 
-	api.RegisterRoutes(e, registry, validator, store, searcher)
+	api.RegisterRoutes(e, registry, validator, resourceStore, searcher, ids, api.WithClock(clock), api.WithSnapshots(store.NewSnapshots(resourceStore, registry, *snapshotDir)))
 
 	go func() {
 		log.Printf("listening on %s", *addr)
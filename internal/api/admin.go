@@ -0,0 +1,108 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+
+	"mini-fhir/internal/store"
+	"mini-fhir/internal/validation"
+)
+
+func (s *Server) handleListSnapshots(c echo.Context) error {
+	snapshots, err := s.Snapshots.List()
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, validation.NewOutcomeIssue("error", "exception", err.Error()))
+	}
+	return c.JSON(http.StatusOK, snapshots)
+}
+
+func (s *Server) handleSaveSnapshot(c echo.Context) error {
+	storage := c.QueryParam("storage")
+	if storage != "" && storage != "memory" && storage != "disk" {
+		return c.JSON(http.StatusBadRequest, validation.NewOutcomeIssue("error", "invalid", "storage must be memory or disk"))
+	}
+	info, err := s.Snapshots.Save(c.Param("name"), storage == "disk")
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, validation.NewOutcomeIssue("error", "invalid", err.Error()))
+	}
+	return c.JSON(http.StatusCreated, info)
+}
+
+func (s *Server) handleRestoreSnapshot(c echo.Context) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	var info *store.SnapshotInfo
+	restore := func() (err error) {
+		info, err = s.Snapshots.Restore(c.Param("name"))
+		return err
+	}
+	var err error
+	if s.sequence != nil {
+		// Server-assigned ids after a restore depend only on the fixture.
+		err = s.sequence.Restore(restore)
+	} else {
+		err = restore()
+	}
+	if errors.Is(err, store.ErrSnapshotNotFound) {
+		return c.JSON(http.StatusNotFound, validation.NewOutcomeIssue("error", "not-found", err.Error()))
+	}
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, validation.NewOutcomeIssue("error", "invalid", err.Error()))
+	}
+	return c.JSON(http.StatusOK, info)
+}
+
+func (s *Server) handleDeleteSnapshot(c echo.Context) error {
+	err := s.Snapshots.Delete(c.Param("name"))
+	if errors.Is(err, store.ErrSnapshotNotFound) {
+		return c.JSON(http.StatusNotFound, validation.NewOutcomeIssue("error", "not-found", err.Error()))
+	}
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, validation.NewOutcomeIssue("error", "invalid", err.Error()))
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+func (s *Server) handleClock(c echo.Context) error {
+	if s.Clock == nil {
+		return c.JSON(http.StatusNotFound, validation.NewOutcomeIssue("error", "not-supported", "clock control is not enabled"))
+	}
+	return c.JSON(http.StatusOK, s.Clock.State())
+}
+
+func (s *Server) handleClockOperation(c echo.Context) error {
+	if s.Clock == nil {
+		return c.JSON(http.StatusNotFound, validation.NewOutcomeIssue("error", "not-supported", "clock control is not enabled"))
+	}
+	var at time.Time
+	if value := c.QueryParam("at"); value != "" {
+		parsed, err := time.Parse(time.RFC3339Nano, value)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, validation.NewOutcomeIssue("error", "invalid", "at must be an RFC3339 instant"))
+		}
+		at = parsed
+	}
+	switch c.Param("operation") {
+	case "$freeze":
+		s.Clock.Freeze(at)
+	case "$set":
+		if at.IsZero() {
+			return c.JSON(http.StatusBadRequest, validation.NewOutcomeIssue("error", "required", "at is required"))
+		}
+		s.Clock.Set(at)
+	case "$advance":
+		by, err := time.ParseDuration(c.QueryParam("by"))
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, validation.NewOutcomeIssue("error", "invalid", "by must be a duration such as 90s or 1h"))
+		}
+		s.Clock.Advance(by)
+	case "$resume":
+		s.Clock.Resume()
+	default:
+		return c.JSON(http.StatusNotFound, validation.NewOutcomeIssue("error", "not-supported", "unknown clock operation"))
+	}
+	return c.JSON(http.StatusOK, s.Clock.State())
+}
@@ -0,0 +1,38 @@
+package api
+
+import (
+	"net/http"
+	"net/url"
+
+	"github.com/labstack/echo/v4"
+
+	"mini-fhir/internal/search"
+	"mini-fhir/internal/validation"
+)
+
+// handleCompartmentSearch searches one resource type within a
+// compartment, as in GET /Patient/123/Observation.
+func (s *Server) handleCompartmentSearch(c echo.Context) error {
+	compartment, id, resourceType := c.Param("type"), c.Param("id"), c.Param("compartmentType")
+	if len(s.Searcher.CompartmentTypes(compartment)) == 0 {
+		return c.JSON(http.StatusNotFound, validation.NewOutcomeIssue("error", "not-found", "no compartment is defined for "+compartment))
+	}
+	if _, ok := s.Registry.Info(resourceType); !ok {
+		return c.JSON(http.StatusNotFound, validation.NewOutcomeIssue("error", "not-found", "resource type not supported"))
+	}
+	path := compartment + "/" + id + "/" + resourceType
+	return s.searchResponse(c, path, s.searchQuery(c, resourceType, c.QueryParams()), func(query url.Values) (*search.SearchResult, error) {
+		return s.Searcher.SearchCompartment(compartment, id, resourceType, query)
+	})
+}
+
+// handleEverything returns a patient and everything in its compartment.
+func (s *Server) handleEverything(c echo.Context) error {
+	if c.Param("type") != "Patient" {
+		return c.JSON(http.StatusNotFound, validation.NewOutcomeIssue("error", "not-supported", "$everything is only supported on Patient"))
+	}
+	id := c.Param("id")
+	return s.searchResponse(c, "Patient/"+id+"/$everything", c.QueryParams(), func(query url.Values) (*search.SearchResult, error) {
+		return s.Searcher.Everything(id, query)
+	})
+}
@@ -2,9 +2,11 @@ package api
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
 	"sort"
@@ -14,10 +16,15 @@ import (
 
 	"mini-fhir/internal/bundle"
 	"mini-fhir/internal/fhir/dstu3"
+	"mini-fhir/internal/search"
 	"mini-fhir/internal/store"
 	"mini-fhir/internal/validation"
 )
 
+// A client may PUT an id the sequence has not reached yet, so create skips
+// taken ids.
+const maxCreateAttempts = 100
+
 func (s *Server) handleMetadata(c echo.Context) error {
 	capability := map[string]any{
 		"resourceType": "CapabilityStatement",
@@ -31,6 +38,11 @@ func (s *Server) handleMetadata(c echo.Context) error {
 				"interaction": []map[string]string{
 					{"code": "batch"},
 					{"code": "transaction"},
+					{"code": "history-system"},
+					{"code": "search-system"},
+				},
+				"operation": []map[string]any{
+					{"name": "everything", "definition": map[string]string{"reference": "http://hl7.org/fhir/OperationDefinition/Patient-everything"}},
 				},
 			},
 		},
@@ -52,20 +64,34 @@ func (s *Server) capabilityResources() []map[string]any {
 				{"code": "delete"},
 				{"code": "create"},
 				{"code": "history-instance"},
+				{"code": "history-type"},
 				{"code": "search-type"},
 			},
-			"searchParam": []map[string]string{
-				{"name": "_include"},
-				{"name": "_include:iterate"},
-				{"name": "_profile"},
-				{"name": "_count"},
-				{"name": "_sort"},
-			},
+			"searchParam": s.capabilitySearchParams(resourceType),
 		})
 	}
 	return resources
 }
 
+func (s *Server) capabilitySearchParams(resourceType string) []map[string]string {
+	params := []map[string]string{
+		{"name": "_include"},
+		{"name": "_include:iterate"},
+		{"name": "_revinclude"},
+		{"name": "_revinclude:iterate"},
+		{"name": "_count"},
+		{"name": "_sort"},
+	}
+	for _, param := range s.Searcher.Params(resourceType) {
+		entry := map[string]string{"name": param.Code, "type": string(param.Type)}
+		if param.Definition != "" {
+			entry["definition"] = param.Definition
+		}
+		params = append(params, entry)
+	}
+	return params
+}
+
 func (s *Server) handleCreate(c echo.Context) error {
 	resource, err := s.decodeBody(c)
 	if err != nil {
@@ -74,25 +100,91 @@ func (s *Server) handleCreate(c echo.Context) error {
 	if resource.GetResourceType() != c.Param("type") {
 		return c.JSON(http.StatusBadRequest, validation.NewOutcomeIssue("error", "invalid", "resourceType does not match URL"))
 	}
-	if resource.GetID() == "" {
-		return c.JSON(http.StatusBadRequest, validation.NewOutcomeIssue("error", "required", "id is required"))
-	}
 	if outcome := s.Validator.Validate(resource, ""); outcome != nil {
 		return c.JSON(http.StatusUnprocessableEntity, outcome)
 	}
-	entry, err := s.Store.Create(resource)
+	if criteria := c.Request().Header.Get("If-None-Exist"); criteria != "" {
+		query, err := url.ParseQuery(criteria)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, validation.NewOutcomeIssue("error", "invalid", err.Error()))
+		}
+		s.writeMu.Lock()
+		defer s.writeMu.Unlock()
+		matches, err := s.conditionalMatches(c.Param("type"), query)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, validation.NewOutcomeIssue("error", "invalid", err.Error()))
+		}
+		switch len(matches) {
+		case 0:
+		case 1:
+			setVersionHeaders(c, matches[0])
+			return c.JSON(http.StatusOK, matches[0].Resource)
+		default:
+			return c.JSON(http.StatusPreconditionFailed, validation.NewOutcomeIssue("error", "multiple-matches", "If-None-Exist criteria matched multiple resources"))
+		}
+		return s.create(c, resource)
+	}
+	s.writeMu.RLock()
+	defer s.writeMu.RUnlock()
+	return s.create(c, resource)
+}
+
+// create stores resource under a new server-assigned id. The caller must
+// hold writeMu.
+func (s *Server) create(c echo.Context, resource dstu3.Resource) error {
+	var entry *store.ResourceEntry
+	var err error
+	for attempt := 0; attempt < maxCreateAttempts; attempt++ {
+		resource.SetID(s.IDs(resource.GetResourceType()))
+		entry, err = s.Store.Create(resource)
+		if !errors.Is(err, store.ErrExists) {
+			break
+		}
+	}
 	if err != nil {
-		return c.JSON(http.StatusConflict, validation.NewOutcomeIssue("error", "conflict", err.Error()))
+		return writeError(c, err)
 	}
+	setVersionHeaders(c, entry)
+	c.Response().Header().Set(echo.HeaderLocation, versionLocation(c, entry))
 	return c.JSON(http.StatusCreated, entry.Resource)
 }
 
 func (s *Server) handleRead(c echo.Context) error {
 	entry, err := s.Store.Get(c.Param("type"), c.Param("id"))
+	if err != nil {
+		return readError(c, err)
+	}
+	setVersionHeaders(c, entry)
+	return shapedResponse(c, entry.Resource)
+}
+
+func (s *Server) handleVRead(c echo.Context) error {
+	version, err := s.Store.Version(c.Param("type"), c.Param("id"), c.Param("vid"))
 	if err != nil {
 		return c.JSON(http.StatusNotFound, validation.NewOutcomeIssue("error", "not-found", err.Error()))
 	}
-	return c.JSON(http.StatusOK, entry.Resource)
+	if version.Deleted {
+		return readError(c, store.ErrGone)
+	}
+	c.Response().Header().Set("ETag", fmt.Sprintf(`W/"%s"`, version.VersionID))
+	return shapedResponse(c, version.Resource)
+}
+
+// shapedResponse writes resource reduced by any _summary or _elements
+// in the request.
+func shapedResponse(c echo.Context, resource dstu3.Resource) error {
+	sh, err := parseShaping(c.QueryParams())
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, validation.NewOutcomeIssue("error", "invalid", err.Error()))
+	}
+	if sh.summary == "count" {
+		return c.JSON(http.StatusBadRequest, validation.NewOutcomeIssue("error", "invalid", "_summary=count applies only to searches"))
+	}
+	shaped, err := sh.apply(resource)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, validation.NewOutcomeIssue("error", "exception", err.Error()))
+	}
+	return c.JSON(http.StatusOK, shaped)
 }
 
 func (s *Server) handleUpdate(c echo.Context) error {
@@ -107,56 +199,233 @@ func (s *Server) handleUpdate(c echo.Context) error {
 	if outcome := s.Validator.Validate(resource, ""); outcome != nil {
 		return c.JSON(http.StatusUnprocessableEntity, outcome)
 	}
-	entry, err := s.Store.Update(resource)
+	s.writeMu.RLock()
+	defer s.writeMu.RUnlock()
+	entry, err := s.Store.Update(resource, ifMatchVersion(c))
+	if errors.Is(err, store.ErrConflict) {
+		return c.JSON(http.StatusPreconditionFailed, validation.NewOutcomeIssue("error", "conflict", err.Error()))
+	}
 	if err != nil {
 		return c.JSON(http.StatusBadRequest, validation.NewOutcomeIssue("error", "invalid", err.Error()))
 	}
+	setVersionHeaders(c, entry)
 	return c.JSON(http.StatusOK, entry.Resource)
 }
 
 func (s *Server) handleDelete(c echo.Context) error {
-	if err := s.Store.Delete(c.Param("type"), c.Param("id")); err != nil {
+	s.writeMu.RLock()
+	defer s.writeMu.RUnlock()
+	err := s.Store.Delete(c.Param("type"), c.Param("id"), ifMatchVersion(c))
+	if errors.Is(err, store.ErrConflict) {
+		return c.JSON(http.StatusPreconditionFailed, validation.NewOutcomeIssue("error", "conflict", err.Error()))
+	}
+	if err != nil {
 		return c.JSON(http.StatusNotFound, validation.NewOutcomeIssue("error", "not-found", err.Error()))
 	}
 	return c.NoContent(http.StatusNoContent)
 }
 
-func (s *Server) handleHistory(c echo.Context) error {
-	resources, err := s.Store.History(c.Param("type"), c.Param("id"))
+func (s *Server) handleConditionalUpdate(c echo.Context) error {
+	resource, err := s.decodeBody(c)
 	if err != nil {
-		return c.JSON(http.StatusNotFound, validation.NewOutcomeIssue("error", "not-found", err.Error()))
+		return c.JSON(http.StatusBadRequest, validation.NewOutcomeIssue("error", "invalid", err.Error()))
+	}
+	if resource.GetResourceType() != c.Param("type") {
+		return c.JSON(http.StatusBadRequest, validation.NewOutcomeIssue("error", "invalid", "resourceType does not match URL"))
+	}
+	if outcome := s.Validator.Validate(resource, ""); outcome != nil {
+		return c.JSON(http.StatusUnprocessableEntity, outcome)
+	}
+
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	matches, err := s.conditionalMatches(c.Param("type"), c.QueryParams())
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, validation.NewOutcomeIssue("error", "invalid", err.Error()))
+	}
+	switch len(matches) {
+	case 0:
+		return s.create(c, resource)
+	case 1:
+	default:
+		return c.JSON(http.StatusPreconditionFailed, validation.NewOutcomeIssue("error", "multiple-matches", "conditional update criteria matched multiple resources"))
 	}
-	searchBundle := bundle.NewSearchBundle(len(resources))
-	for _, res := range resources {
-		searchBundle.Entry = append(searchBundle.Entry, bundle.Entry{Resource: res})
+
+	id := matches[0].Resource.GetID()
+	if resource.GetID() != "" && resource.GetID() != id {
+		return c.JSON(http.StatusBadRequest, validation.NewOutcomeIssue("error", "invalid", "resource id does not match the conditional match"))
 	}
-	return c.JSON(http.StatusOK, searchBundle)
+	resource.SetID(id)
+	entry, err := s.Store.Update(resource, ifMatchVersion(c))
+	if err != nil {
+		return writeError(c, err)
+	}
+	setVersionHeaders(c, entry)
+	return c.JSON(http.StatusOK, entry.Resource)
 }
 
-func (s *Server) handleSystemHistory(c echo.Context) error {
-	resources := s.Store.SystemHistory()
-	searchBundle := bundle.NewSearchBundle(len(resources))
-	for _, res := range resources {
-		searchBundle.Entry = append(searchBundle.Entry, bundle.Entry{Resource: res})
+func (s *Server) handleConditionalDelete(c echo.Context) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	matches, err := s.conditionalMatches(c.Param("type"), c.QueryParams())
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, validation.NewOutcomeIssue("error", "invalid", err.Error()))
+	}
+	switch len(matches) {
+	case 0:
+		return c.NoContent(http.StatusNoContent)
+	case 1:
+	default:
+		return c.JSON(http.StatusPreconditionFailed, validation.NewOutcomeIssue("error", "multiple-matches", "conditional delete criteria matched multiple resources"))
+	}
+	if err := s.Store.Delete(c.Param("type"), matches[0].Resource.GetID(), ifMatchVersion(c)); err != nil {
+		return writeError(c, err)
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+func (s *Server) conditionalMatches(resourceType string, query url.Values) ([]*store.ResourceEntry, error) {
+	if _, ok := s.Registry.Info(resourceType); !ok {
+		return nil, fmt.Errorf("resource type not supported")
+	}
+	if len(query) == 0 {
+		return nil, fmt.Errorf("conditional criteria are required")
+	}
+	return s.Searcher.Match(resourceType, query)
+}
+
+func setVersionHeaders(c echo.Context, entry *store.ResourceEntry) {
+	c.Response().Header().Set("ETag", fmt.Sprintf(`W/"%s"`, entry.VersionID))
+}
+
+// ifMatchVersion extracts the version from an If-Match header such as W/"3".
+// "*" is returned as store.AnyVersion.
+func ifMatchVersion(c echo.Context) string {
+	value := strings.TrimSpace(c.Request().Header.Get("If-Match"))
+	value = strings.TrimPrefix(value, "W/")
+	return strings.Trim(value, `"`)
+}
+
+func versionLocation(c echo.Context, entry *store.ResourceEntry) string {
+	return fmt.Sprintf("%s://%s/%s/%s/_history/%s", c.Scheme(), c.Request().Host, entry.Resource.GetResourceType(), entry.Resource.GetID(), entry.VersionID)
+}
+
+// writeError answers a failed store write: 409 when the id is taken, 412
+// when the expected version does not match, 404 or 410 when the resource
+// is missing, and 500 for anything else, such as a failed log append.
+func writeError(c echo.Context, err error) error {
+	switch {
+	case errors.Is(err, store.ErrExists):
+		return c.JSON(http.StatusConflict, validation.NewOutcomeIssue("error", "conflict", err.Error()))
+	case errors.Is(err, store.ErrConflict):
+		return c.JSON(http.StatusPreconditionFailed, validation.NewOutcomeIssue("error", "conflict", err.Error()))
+	case errors.Is(err, store.ErrNotFound), errors.Is(err, store.ErrGone):
+		return readError(c, err)
+	default:
+		return c.JSON(http.StatusInternalServerError, validation.NewOutcomeIssue("error", "exception", err.Error()))
+	}
+}
+
+func readError(c echo.Context, err error) error {
+	if errors.Is(err, store.ErrGone) {
+		return c.JSON(http.StatusGone, validation.NewOutcomeIssue("error", "deleted", err.Error()))
 	}
-	return c.JSON(http.StatusOK, searchBundle)
+	return c.JSON(http.StatusNotFound, validation.NewOutcomeIssue("error", "not-found", err.Error()))
 }
 
 func (s *Server) handleSearch(c echo.Context) error {
-	resourceType := c.Param("type")
+	return s.typeSearch(c, c.Param("type"), c.QueryParams())
+}
+
+// handlePostSearch runs a search whose criteria arrive in a form body,
+// merged with any query-string parameters.
+func (s *Server) handlePostSearch(c echo.Context) error {
+	contentType, _, _ := strings.Cut(c.Request().Header.Get(echo.HeaderContentType), ";")
+	if strings.TrimSpace(contentType) != echo.MIMEApplicationForm {
+		return c.JSON(http.StatusUnsupportedMediaType, validation.NewOutcomeIssue("error", "not-supported", "search body must be application/x-www-form-urlencoded"))
+	}
+	body, err := io.ReadAll(c.Request().Body)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, validation.NewOutcomeIssue("error", "invalid", err.Error()))
+	}
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, validation.NewOutcomeIssue("error", "invalid", err.Error()))
+	}
+	query := url.Values{}
+	for key, values := range c.QueryParams() {
+		query[key] = append(query[key], values...)
+	}
+	for key, values := range form {
+		query[key] = append(query[key], values...)
+	}
+	return s.typeSearch(c, c.Param("type"), query)
+}
+
+func (s *Server) typeSearch(c echo.Context, resourceType string, query url.Values) error {
 	if _, ok := s.Registry.Info(resourceType); !ok {
 		return c.JSON(http.StatusNotFound, validation.NewOutcomeIssue("error", "not-found", "resource type not supported"))
 	}
-	result, err := s.Searcher.Search(resourceType, c.QueryParams())
+	return s.searchResponse(c, resourceType, s.searchQuery(c, resourceType, query), func(query url.Values) (*search.SearchResult, error) {
+		return s.Searcher.Search(resourceType, query)
+	})
+}
+
+// handleSystemSearch searches across the types named in _type, or all
+// types when it is absent.
+func (s *Server) handleSystemSearch(c echo.Context) error {
+	return s.searchResponse(c, "", s.searchQuery(c, "", c.QueryParams()), s.Searcher.SearchSystem)
+}
+
+// searchQuery drops the parameters the searched types do not define,
+// unless the client asks for strict handling with "Prefer:
+// handling=strict". Conditional operations always use strict handling.
+func (s *Server) searchQuery(c echo.Context, resourceType string, query url.Values) url.Values {
+	for _, value := range c.Request().Header.Values("Prefer") {
+		for _, preference := range strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == ';' }) {
+			if strings.EqualFold(strings.ReplaceAll(preference, " ", ""), "handling=strict") {
+				return query
+			}
+		}
+	}
+	return s.Searcher.IgnoreUnknown(resourceType, query)
+}
+
+// searchResponse runs a search and answers with a searchset Bundle whose
+// links are relative to path.
+func (s *Server) searchResponse(c echo.Context, path string, query url.Values, run func(url.Values) (*search.SearchResult, error)) error {
+	sh, err := parseShaping(query)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, validation.NewOutcomeIssue("error", "invalid", err.Error()))
+	}
+	result, err := run(query)
+	if errors.Is(err, store.ErrNotFound) || errors.Is(err, store.ErrGone) {
+		return readError(c, err)
+	}
+	if errors.Is(err, search.ErrPageNotFound) {
+		return c.JSON(http.StatusGone, validation.NewOutcomeIssue("error", "not-found", err.Error()))
+	}
 	if err != nil {
 		return c.JSON(http.StatusBadRequest, validation.NewOutcomeIssue("error", "invalid", err.Error()))
 	}
 	bundleResp := bundle.NewSearchBundle(result.Count)
+	if sh.summary == "count" {
+		return c.JSON(http.StatusOK, bundleResp)
+	}
+	bundleResp.Link = searchLinks(c, path, query, result)
 	for _, entry := range result.Entries {
-		bundleResp.Entry = append(bundleResp.Entry, bundle.Entry{Resource: entry.Resource})
+		resource, err := sh.apply(entry.Resource)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, validation.NewOutcomeIssue("error", "exception", err.Error()))
+		}
+		bundleResp.Entry = append(bundleResp.Entry, bundle.Entry{Resource: resource})
 	}
 	for _, entry := range result.Included {
-		bundleResp.Entry = append(bundleResp.Entry, bundle.Entry{Resource: entry.Resource, Search: &bundle.EntrySearch{Mode: "include"}})
+		resource, err := sh.apply(entry.Resource)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, validation.NewOutcomeIssue("error", "exception", err.Error()))
+		}
+		bundleResp.Entry = append(bundleResp.Entry, bundle.Entry{Resource: resource, Search: &bundle.EntrySearch{Mode: "include"}})
 	}
 	return c.JSON(http.StatusOK, bundleResp)
 }
@@ -192,6 +461,8 @@ func (s *Server) handleBatchTransaction(c echo.Context) error {
 	}
 
 	responseBundle := bundle.NewBatchResponseBundle()
+	s.writeMu.RLock()
+	defer s.writeMu.RUnlock()
 	for _, entry := range bundleReq.Entry {
 		resp := bundle.Entry{Response: &bundle.EntryResponse{Status: "400"}}
 		if resourceRaw, ok := entry["resource"]; ok {
@@ -199,7 +470,7 @@ func (s *Server) handleBatchTransaction(c echo.Context) error {
 			resource, err := s.Registry.DecodeResource(resourceBytes)
 			if err == nil {
 				if outcome := s.Validator.Validate(resource, ""); outcome == nil {
-					if _, err := s.Store.Update(resource); err == nil {
+					if _, err := s.Store.Update(resource, ""); err == nil {
 						resp.Response.Status = "200"
 					} else {
 						resp.Response.Status = "400"
@@ -212,7 +483,7 @@ func (s *Server) handleBatchTransaction(c echo.Context) error {
 	return c.JSON(http.StatusOK, responseBundle)
 }
 
-func LoadSeed(pattern string, strict bool, registry *dstu3.Registry, validator *validation.Validator, store *store.Store) error {
+func LoadSeed(pattern string, strict bool, registry *dstu3.Registry, validator *validation.Validator, store store.Store) error {
 	matches, err := filepath.Glob(pattern)
 	if err != nil {
 		return err
@@ -248,7 +519,7 @@ func LoadSeed(pattern string, strict bool, registry *dstu3.Registry, validator *
 	return nil
 }
 
-func loadSeedResource(data []byte, strict bool, registry *dstu3.Registry, validator *validation.Validator, store *store.Store) error {
+func loadSeedResource(data []byte, strict bool, registry *dstu3.Registry, validator *validation.Validator, store store.Store) error {
 	resource, err := registry.DecodeResource(data)
 	if err != nil {
 		if strict {
@@ -268,7 +539,7 @@ func loadSeedResource(data []byte, strict bool, registry *dstu3.Registry, valida
 		}
 		return nil
 	}
-	if _, err := store.Update(resource); err != nil {
+	if _, err := store.Update(resource, ""); err != nil {
 		if strict {
 			return err
 		}
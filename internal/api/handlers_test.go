@@ -3,8 +3,12 @@ package api
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
 	"testing"
 
 	"github.com/labstack/echo/v4"
@@ -23,7 +27,7 @@ type outcomeResponse struct {
 	} `json:"issue"`
 }
 
-func setupTestServer() (*echo.Echo, *dstu3.Registry) {
+func setupTestServer(opts ...Option) (*echo.Echo, *dstu3.Registry) {
 	registry := dstu3.NewRegistry()
 	profileStore := validation.NewProfileStore("", 0, validation.CacheVersion)
 	for _, resourceType := range registry.ResourceTypes() {
@@ -34,10 +38,13 @@ func setupTestServer() (*echo.Echo, *dstu3.Registry) {
 		profileStore.Add(info.ProfileSource, &validation.RuleSet{ResourceType: resourceType})
 	}
 	validator := validation.NewValidator(registry, profileStore)
-	store := store.NewStore()
+	clock := store.NewAdjustableClock()
+	store := store.NewMemoryStore()
+	store.SetClock(clock)
 	searcher := search.NewSearcher(registry, store)
+	validator.AddCheck("SearchParameter", searcher.CheckSearchParameter)
 	e := echo.New()
-	RegisterRoutes(e, registry, validator, store, searcher)
+	RegisterRoutes(e, registry, validator, store, searcher, append([]Option{WithClock(clock)}, opts...)...)
 	return e, registry
 }
 
@@ -99,3 +106,867 @@ func TestCreateRejectsUnknownFields(t *testing.T) {
 		t.Fatalf("expected 400, got %d", recorder.Code)
 	}
 }
+
+func TestVReadReturnsHistoricalVersion(t *testing.T) {
+	e, _ := setupTestServer()
+	for _, gender := range []string{"female", "male"} {
+		payload := []byte(`{"resourceType":"Patient","id":"pat-1","gender":"` + gender + `"}`)
+		request := httptest.NewRequest(http.MethodPut, "/Patient/pat-1", bytes.NewReader(payload))
+		request.Header.Set("Content-Type", "application/json")
+		recorder := httptest.NewRecorder()
+		e.ServeHTTP(recorder, request)
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d", recorder.Code)
+		}
+	}
+
+	request := httptest.NewRequest(http.MethodGet, "/Patient/pat-1/_history/1", nil)
+	recorder := httptest.NewRecorder()
+	e.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", recorder.Code)
+	}
+	var patient dstu3.Patient
+	if err := json.Unmarshal(recorder.Body.Bytes(), &patient); err != nil {
+		t.Fatalf("decode patient failed: %v", err)
+	}
+	if patient.Gender != "female" || patient.Meta == nil || patient.Meta.VersionID != "1" || patient.Meta.LastUpdated == "" {
+		t.Fatalf("unexpected version 1: %+v", patient)
+	}
+
+	request = httptest.NewRequest(http.MethodGet, "/Patient/pat-1/_history/9", nil)
+	recorder = httptest.NewRecorder()
+	e.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusNotFound {
+		t.Fatalf("expected 404, got %d", recorder.Code)
+	}
+	var outcome outcomeResponse
+	if err := json.Unmarshal(recorder.Body.Bytes(), &outcome); err != nil || outcome.ResourceType != "OperationOutcome" || outcome.Issue[0].Code != "not-found" {
+		t.Fatalf("expected not-found OperationOutcome, got %s", recorder.Body.String())
+	}
+}
+
+func performRequest(e *echo.Echo, method, target string, body []byte) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(method, target, bytes.NewReader(body))
+	request.Header.Set("Content-Type", "application/json")
+	recorder := httptest.NewRecorder()
+	e.ServeHTTP(recorder, request)
+	return recorder
+}
+
+func TestDeleteRecordsTombstone(t *testing.T) {
+	e, _ := setupTestServer()
+	payload := []byte(`{"resourceType":"Patient","id":"pat-1"}`)
+	if recorder := performRequest(e, http.MethodPut, "/Patient/pat-1", payload); recorder.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", recorder.Code)
+	}
+	if recorder := performRequest(e, http.MethodDelete, "/Patient/pat-1", nil); recorder.Code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", recorder.Code)
+	}
+	if recorder := performRequest(e, http.MethodGet, "/Patient/pat-1", nil); recorder.Code != http.StatusGone {
+		t.Fatalf("expected 410, got %d", recorder.Code)
+	}
+
+	recorder := performRequest(e, http.MethodGet, "/Patient/pat-1/_history", nil)
+	var history struct {
+		Entry []struct {
+			Request *struct {
+				Method string `json:"method"`
+			} `json:"request"`
+		} `json:"entry"`
+	}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &history); err != nil {
+		t.Fatalf("decode history failed: %v", err)
+	}
+	if len(history.Entry) != 2 || history.Entry[0].Request == nil || history.Entry[0].Request.Method != http.MethodDelete {
+		t.Fatalf("expected delete at the head of history, got %s", recorder.Body.String())
+	}
+
+	recorder = performRequest(e, http.MethodPut, "/Patient/pat-1", payload)
+	var patient dstu3.Patient
+	if err := json.Unmarshal(recorder.Body.Bytes(), &patient); err != nil {
+		t.Fatalf("decode patient failed: %v", err)
+	}
+	if patient.Meta == nil || patient.Meta.VersionID != "3" {
+		t.Fatalf("expected version 3 after re-create, got %+v", patient.Meta)
+	}
+}
+
+func TestCreateAssignsServerID(t *testing.T) {
+	e, _ := setupTestServer(WithSequenceIDs())
+	if recorder := performRequest(e, http.MethodPut, "/Patient/1", []byte(`{"resourceType":"Patient","id":"1"}`)); recorder.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", recorder.Code)
+	}
+
+	recorder := performRequest(e, http.MethodPost, "/Patient", []byte(`{"resourceType":"Patient","id":"client-id"}`))
+	if recorder.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d", recorder.Code)
+	}
+	var patient dstu3.Patient
+	if err := json.Unmarshal(recorder.Body.Bytes(), &patient); err != nil {
+		t.Fatalf("decode patient failed: %v", err)
+	}
+	if patient.ID != "2" {
+		t.Fatalf("expected server-assigned id 2, got %q", patient.ID)
+	}
+	if location := recorder.Header().Get("Location"); location != "http://example.com/Patient/2/_history/1" {
+		t.Fatalf("unexpected Location %q", location)
+	}
+	if etag := recorder.Header().Get("ETag"); etag != `W/"1"` {
+		t.Fatalf("unexpected ETag %q", etag)
+	}
+
+	// Deleted ids stay taken, and a type's sequence starts past them.
+	performRequest(e, http.MethodPut, "/Practitioner/7", []byte(`{"resourceType":"Practitioner","id":"7"}`))
+	performRequest(e, http.MethodDelete, "/Practitioner/7", nil)
+	recorder = performRequest(e, http.MethodPost, "/Practitioner", []byte(`{"resourceType":"Practitioner"}`))
+	if location := recorder.Header().Get("Location"); location != "http://example.com/Practitioner/8/_history/1" {
+		t.Fatalf("expected a new Practitioner/8, got Location %q", location)
+	}
+	ids := []string{"7", "9"}
+	e, _ = setupTestServer(WithIDGenerator(func(string) string {
+		id := ids[0]
+		ids = ids[1:]
+		return id
+	}))
+	performRequest(e, http.MethodPut, "/Patient/7", []byte(`{"resourceType":"Patient","id":"7"}`))
+	performRequest(e, http.MethodDelete, "/Patient/7", nil)
+	recorder = performRequest(e, http.MethodPost, "/Patient", []byte(`{"resourceType":"Patient"}`))
+	if location := recorder.Header().Get("Location"); location != "http://example.com/Patient/9/_history/1" {
+		t.Fatalf("expected create to skip the deleted id, got Location %q", location)
+	}
+}
+
+func TestIfMatchOptimisticLocking(t *testing.T) {
+	e, _ := setupTestServer()
+	payload := []byte(`{"resourceType":"Patient","id":"pat-1"}`)
+	performRequest(e, http.MethodPut, "/Patient/pat-1", payload)
+
+	read := performRequest(e, http.MethodGet, "/Patient/pat-1", nil)
+	if etag := read.Header().Get("ETag"); etag != `W/"1"` {
+		t.Fatalf("expected ETag W/\"1\", got %q", etag)
+	}
+
+	request := httptest.NewRequest(http.MethodPut, "/Patient/pat-1", bytes.NewReader(payload))
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("If-Match", `W/"1"`)
+	recorder := httptest.NewRecorder()
+	e.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusOK || recorder.Header().Get("ETag") != `W/"2"` {
+		t.Fatalf("expected 200 with ETag W/\"2\", got %d %q", recorder.Code, recorder.Header().Get("ETag"))
+	}
+
+	for _, method := range []string{http.MethodPut, http.MethodDelete} {
+		request := httptest.NewRequest(method, "/Patient/pat-1", bytes.NewReader(payload))
+		request.Header.Set("Content-Type", "application/json")
+		request.Header.Set("If-Match", `W/"1"`)
+		recorder := httptest.NewRecorder()
+		e.ServeHTTP(recorder, request)
+		if recorder.Code != http.StatusPreconditionFailed {
+			t.Fatalf("%s: expected 412, got %d", method, recorder.Code)
+		}
+	}
+
+	vread := performRequest(e, http.MethodGet, "/Patient/pat-1/_history/2", nil)
+	if etag := vread.Header().Get("ETag"); etag != `W/"2"` {
+		t.Fatalf("expected vread ETag W/\"2\", got %q", etag)
+	}
+	ifMatchAny := func(method, target string) int {
+		request := httptest.NewRequest(method, target, bytes.NewReader(payload))
+		request.Header.Set("Content-Type", "application/json")
+		request.Header.Set("If-Match", "*")
+		recorder := httptest.NewRecorder()
+		e.ServeHTTP(recorder, request)
+		return recorder.Code
+	}
+	if code := ifMatchAny(http.MethodPut, "/Patient/pat-1"); code != http.StatusOK {
+		t.Fatalf("expected If-Match: * to match the current version, got %d", code)
+	}
+	if code := ifMatchAny(http.MethodDelete, "/Patient/pat-1"); code != http.StatusNoContent {
+		t.Fatalf("expected If-Match: * delete to succeed, got %d", code)
+	}
+	if code := ifMatchAny(http.MethodPut, "/Patient/pat-1"); code != http.StatusPreconditionFailed {
+		t.Fatalf("expected If-Match: * to fail on a deleted resource, got %d", code)
+	}
+}
+
+func TestConditionalCreateUpdateDelete(t *testing.T) {
+	e, _ := setupTestServer()
+	payload := []byte(`{"resourceType":"Patient","identifier":[{"system":"urn:mrn","value":"123"}]}`)
+	create := func() *httptest.ResponseRecorder {
+		request := httptest.NewRequest(http.MethodPost, "/Patient", bytes.NewReader(payload))
+		request.Header.Set("Content-Type", "application/json")
+		request.Header.Set("If-None-Exist", "identifier=urn:mrn|123")
+		recorder := httptest.NewRecorder()
+		e.ServeHTTP(recorder, request)
+		return recorder
+	}
+	if recorder := create(); recorder.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d", recorder.Code)
+	}
+	if recorder := create(); recorder.Code != http.StatusOK {
+		t.Fatalf("expected 200 for existing match, got %d", recorder.Code)
+	}
+
+	update := []byte(`{"resourceType":"Patient","gender":"female","identifier":[{"system":"urn:mrn","value":"123"}]}`)
+	recorder := performRequest(e, http.MethodPut, "/Patient?identifier=urn:mrn|123", update)
+	if recorder.Code != http.StatusOK || recorder.Header().Get("ETag") != `W/"2"` {
+		t.Fatalf("expected 200 with version 2, got %d %q", recorder.Code, recorder.Header().Get("ETag"))
+	}
+
+	performRequest(e, http.MethodPut, "/Patient/other", []byte(`{"resourceType":"Patient","id":"other","identifier":[{"system":"urn:mrn","value":"123"}]}`))
+	if recorder := create(); recorder.Code != http.StatusPreconditionFailed {
+		t.Fatalf("expected 412 for multiple matches, got %d", recorder.Code)
+	}
+	if recorder := performRequest(e, http.MethodDelete, "/Patient?_id=other", nil); recorder.Code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", recorder.Code)
+	}
+	if recorder := performRequest(e, http.MethodGet, "/Patient/other", nil); recorder.Code != http.StatusGone {
+		t.Fatalf("expected 410 after conditional delete, got %d", recorder.Code)
+	}
+	request := httptest.NewRequest(http.MethodDelete, "/Patient?identifier=urn:mrn|123", nil)
+	request.Header.Set("If-Match", `W/"1"`)
+	stale := httptest.NewRecorder()
+	e.ServeHTTP(stale, request)
+	if stale.Code != http.StatusPreconditionFailed {
+		t.Fatalf("expected 412 for a stale If-Match on conditional delete, got %d", stale.Code)
+	}
+}
+
+func TestConditionalDeleteReportsStoreErrors(t *testing.T) {
+	registry := dstu3.NewRegistry()
+	fileStore, err := store.OpenFileStore(t.TempDir(), registry, 100)
+	if err != nil {
+		t.Fatalf("open store failed: %v", err)
+	}
+	if _, err := fileStore.Update(&dstu3.Patient{ResourceBase: dstu3.ResourceBase{ResourceType: "Patient", ID: "pat-1"}}, ""); err != nil {
+		t.Fatalf("update failed: %v", err)
+	}
+	if err := fileStore.Close(); err != nil {
+		t.Fatalf("close failed: %v", err)
+	}
+	e := echo.New()
+	RegisterRoutes(e, registry, validation.NewValidator(registry, nil), fileStore, search.NewSearcher(registry, fileStore))
+	if recorder := performRequest(e, http.MethodDelete, "/Patient?_id=pat-1", nil); recorder.Code != http.StatusInternalServerError {
+		t.Fatalf("expected 500 when the store cannot write, got %d", recorder.Code)
+	}
+}
+
+func TestSnapshotRestore(t *testing.T) {
+	e, _ := setupTestServer()
+	performRequest(e, http.MethodPut, "/Patient/pat-1", []byte(`{"resourceType":"Patient","id":"pat-1"}`))
+	if recorder := performRequest(e, http.MethodPost, "/_admin/snapshots/fixture", nil); recorder.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d", recorder.Code)
+	}
+
+	performRequest(e, http.MethodPut, "/Patient/pat-1", []byte(`{"resourceType":"Patient","id":"pat-1","gender":"male"}`))
+	performRequest(e, http.MethodPut, "/Patient/pat-2", []byte(`{"resourceType":"Patient","id":"pat-2"}`))
+
+	if recorder := performRequest(e, http.MethodPost, "/_admin/snapshots/fixture/$restore", nil); recorder.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", recorder.Code)
+	}
+	if recorder := performRequest(e, http.MethodGet, "/Patient/pat-2", nil); recorder.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 after restore, got %d", recorder.Code)
+	}
+	recorder := performRequest(e, http.MethodPut, "/Patient/pat-1", []byte(`{"resourceType":"Patient","id":"pat-1"}`))
+	if etag := recorder.Header().Get("ETag"); etag != `W/"2"` {
+		t.Fatalf("expected version counter to restart from the snapshot, got %q", etag)
+	}
+	if recorder := performRequest(e, http.MethodPost, "/_admin/snapshots/missing/$restore", nil); recorder.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for unknown snapshot, got %d", recorder.Code)
+	}
+
+	// Sequence ids restart from the restored state.
+	e, _ = setupTestServer(WithSequenceIDs())
+	performRequest(e, http.MethodPut, "/Patient/1", []byte(`{"resourceType":"Patient","id":"1"}`))
+	performRequest(e, http.MethodPost, "/_admin/snapshots/fixture", nil)
+	for run := 0; run < 2; run++ {
+		for _, want := range []string{"2", "3"} {
+			recorder := performRequest(e, http.MethodPost, "/Patient", []byte(`{"resourceType":"Patient"}`))
+			if location := recorder.Header().Get("Location"); location != "http://example.com/Patient/"+want+"/_history/1" {
+				t.Fatalf("run %d: expected Patient/%s, got Location %q", run, want, location)
+			}
+		}
+		performRequest(e, http.MethodPost, "/_admin/snapshots/fixture/$restore", nil)
+	}
+}
+
+func TestSystemAndTypeHistory(t *testing.T) {
+	e, _ := setupTestServer()
+	performRequest(e, http.MethodPut, "/Patient/pat-1", []byte(`{"resourceType":"Patient","id":"pat-1"}`))
+	performRequest(e, http.MethodPut, "/Organization/org-1", []byte(`{"resourceType":"Organization","id":"org-1"}`))
+	performRequest(e, http.MethodPut, "/Patient/pat-1", []byte(`{"resourceType":"Patient","id":"pat-1","gender":"male"}`))
+	performRequest(e, http.MethodDelete, "/Organization/org-1", nil)
+
+	type historyBundle struct {
+		Type  string `json:"type"`
+		Total int    `json:"total"`
+		Link  []struct {
+			Relation string `json:"relation"`
+			URL      string `json:"url"`
+		} `json:"link"`
+		Entry []struct {
+			FullURL string `json:"fullUrl"`
+			Request struct {
+				Method string `json:"method"`
+			} `json:"request"`
+			Response struct {
+				Status string `json:"status"`
+				Etag   string `json:"etag"`
+			} `json:"response"`
+		} `json:"entry"`
+	}
+	decode := func(recorder *httptest.ResponseRecorder) historyBundle {
+		var out historyBundle
+		if err := json.Unmarshal(recorder.Body.Bytes(), &out); err != nil {
+			t.Fatalf("decode history failed: %v", err)
+		}
+		return out
+	}
+
+	system := decode(performRequest(e, http.MethodGet, "/_history", nil))
+	if system.Type != "history" || system.Total != 4 || len(system.Entry) != 4 {
+		t.Fatalf("expected 4 history entries, got %+v", system)
+	}
+	again := decode(performRequest(e, http.MethodGet, "/_history", nil))
+	for i := range system.Entry {
+		if system.Entry[i].FullURL != again.Entry[i].FullURL || system.Entry[i].Response.Etag != again.Entry[i].Response.Etag {
+			t.Fatalf("expected deterministic ordering, got %+v then %+v", system.Entry, again.Entry)
+		}
+	}
+
+	typed := decode(performRequest(e, http.MethodGet, "/Patient/_history?_count=1", nil))
+	if typed.Total != 2 || len(typed.Entry) != 1 {
+		t.Fatalf("expected 1 of 2 Patient versions, got %+v", typed)
+	}
+	if entry := typed.Entry[0]; entry.Request.Method != http.MethodPut || entry.Response.Etag != `W/"2"` {
+		t.Fatalf("expected newest Patient version first, got %+v", entry)
+	}
+	instance := decode(performRequest(e, http.MethodGet, "/Patient/pat-1/_history", nil))
+	if entry := instance.Entry[len(instance.Entry)-1]; entry.Request.Method != http.MethodPut || entry.Response.Status != "201" {
+		t.Fatalf("expected version 1 created by PUT, got %+v", entry)
+	}
+	performRequest(e, http.MethodPost, "/Patient", []byte(`{"resourceType":"Patient","id":"pat-2"}`))
+	posted := decode(performRequest(e, http.MethodGet, "/Patient/_history?_count=1", nil))
+	if entry := posted.Entry[0]; entry.Request.Method != http.MethodPost || entry.Response.Status != "201" {
+		t.Fatalf("expected version created by POST, got %+v", entry)
+	}
+
+	performRequest(e, http.MethodPut, "/Organization/org-1", []byte(`{"resourceType":"Organization","id":"org-1"}`))
+	recreated := decode(performRequest(e, http.MethodGet, "/Organization/org-1/_history", nil))
+	if entry := recreated.Entry[0]; entry.Request.Method != http.MethodPut || entry.Response.Status != "201" {
+		t.Fatalf("expected PUT after delete to be reported as created, got %+v", entry)
+	}
+
+	seen := map[string]bool{}
+	page := decode(performRequest(e, http.MethodGet, "/_history?_count=2", nil))
+	for pages := 1; ; pages++ {
+		for _, entry := range page.Entry {
+			seen[entry.FullURL+entry.Response.Etag] = true
+		}
+		next := ""
+		for _, link := range page.Link {
+			if link.Relation == "next" {
+				next = link.URL
+			}
+		}
+		if next == "" {
+			if pages != 3 {
+				t.Fatalf("expected 3 history pages, got %d", pages)
+			}
+			break
+		}
+		page = decode(performRequest(e, http.MethodGet, strings.TrimPrefix(next, "http://example.com"), nil))
+	}
+	if len(seen) != page.Total || page.Total != 6 {
+		t.Fatalf("expected paging to reach all 6 versions, saw %d of %d", len(seen), page.Total)
+	}
+	if recorder := performRequest(e, http.MethodGet, "/_history?_getpagesoffset=-1", nil); recorder.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for invalid offset, got %d", recorder.Code)
+	}
+
+	future := decode(performRequest(e, http.MethodGet, "/_history?_since=2999-01-01", nil))
+	if future.Total != 0 {
+		t.Fatalf("expected no versions since 2999, got %d", future.Total)
+	}
+	if recorder := performRequest(e, http.MethodGet, "/_history?_at=bogus", nil); recorder.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for invalid _at, got %d", recorder.Code)
+	}
+}
+
+func TestAdminClockControlsLastUpdated(t *testing.T) {
+	e, _ := setupTestServer()
+	if recorder := performRequest(e, http.MethodPost, "/_admin/clock/$freeze?at=2024-01-01T00:00:00Z", nil); recorder.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", recorder.Code)
+	}
+	lastUpdated := func(id string) string {
+		recorder := performRequest(e, http.MethodPut, "/Patient/"+id, []byte(`{"resourceType":"Patient","id":"`+id+`"}`))
+		var patient dstu3.Patient
+		if err := json.Unmarshal(recorder.Body.Bytes(), &patient); err != nil {
+			t.Fatalf("decode patient failed: %v", err)
+		}
+		return patient.Meta.LastUpdated
+	}
+	if got := lastUpdated("pat-1"); got != "2024-01-01T00:00:00.000000Z" {
+		t.Fatalf("expected frozen timestamp, got %s", got)
+	}
+	if got := lastUpdated("pat-2"); got != "2024-01-01T00:00:00.000001Z" {
+		t.Fatalf("expected strictly increasing timestamp, got %s", got)
+	}
+	performRequest(e, http.MethodPost, "/_admin/clock/$advance?by=1h", nil)
+	if got := lastUpdated("pat-3"); got != "2024-01-01T01:00:00.000000Z" {
+		t.Fatalf("expected advanced timestamp, got %s", got)
+	}
+	if recorder := performRequest(e, http.MethodPost, "/_admin/clock/$advance?by=soon", nil); recorder.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for invalid duration, got %d", recorder.Code)
+	}
+}
+
+func TestSearchPagingLinksAreStable(t *testing.T) {
+	e, _ := setupTestServer()
+	for i := 1; i <= 5; i++ {
+		performRequest(e, http.MethodPut, fmt.Sprintf("/Patient/pat-%d", i), []byte(fmt.Sprintf(`{"resourceType":"Patient","id":"pat-%d"}`, i)))
+	}
+
+	type searchBundle struct {
+		Total int `json:"total"`
+		Link  []struct {
+			Relation string `json:"relation"`
+			URL      string `json:"url"`
+		} `json:"link"`
+		Entry []struct {
+			Resource struct {
+				ID string `json:"id"`
+			} `json:"resource"`
+		} `json:"entry"`
+	}
+	fetch := func(target string) (searchBundle, map[string]string) {
+		recorder := performRequest(e, http.MethodGet, target, nil)
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("GET %s: expected 200, got %d: %s", target, recorder.Code, recorder.Body.String())
+		}
+		var out searchBundle
+		if err := json.Unmarshal(recorder.Body.Bytes(), &out); err != nil {
+			t.Fatalf("decode search bundle failed: %v", err)
+		}
+		links := map[string]string{}
+		for _, link := range out.Link {
+			parsed, err := url.Parse(link.URL)
+			if err != nil {
+				t.Fatalf("invalid %s link %q", link.Relation, link.URL)
+			}
+			links[link.Relation] = parsed.RequestURI()
+		}
+		return out, links
+	}
+	ids := func(b searchBundle) string {
+		out := []string{}
+		for _, entry := range b.Entry {
+			out = append(out, entry.Resource.ID)
+		}
+		return strings.Join(out, ",")
+	}
+
+	first, links := fetch("/Patient?_count=2")
+	if first.Total != 5 || ids(first) != "pat-1,pat-2" {
+		t.Fatalf("expected first 2 of 5 patients, got %d %s", first.Total, ids(first))
+	}
+	if links["self"] != "/Patient?_count=2" || links["first"] == "" || links["last"] == "" || links["previous"] != "" {
+		t.Fatalf("unexpected first page links: %v", links)
+	}
+
+	performRequest(e, http.MethodDelete, "/Patient/pat-3", nil)
+	performRequest(e, http.MethodPut, "/Patient/pat-0", []byte(`{"resourceType":"Patient","id":"pat-0"}`))
+
+	second, secondLinks := fetch(links["next"])
+	if second.Total != 5 || ids(second) != "pat-3,pat-4" {
+		t.Fatalf("expected page 2 to be unaffected by later writes, got %d %s", second.Total, ids(second))
+	}
+	if secondLinks["previous"] != links["first"] {
+		t.Fatalf("expected previous link to point at the first page, got %v", secondLinks)
+	}
+	last, lastLinks := fetch(links["last"])
+	if ids(last) != "pat-5" || lastLinks["next"] != "" || lastLinks["previous"] == "" {
+		t.Fatalf("unexpected last page %s with links %v", ids(last), lastLinks)
+	}
+
+	if recorder := performRequest(e, http.MethodGet, "/Patient?_getpages=bogus", nil); recorder.Code != http.StatusGone {
+		t.Fatalf("expected 410 for unknown page token, got %d", recorder.Code)
+	}
+}
+
+func TestSummaryAndElements(t *testing.T) {
+	e, _ := setupTestServer()
+	performRequest(e, http.MethodPut, "/Patient/pat-1", []byte(`{"resourceType":"Patient","id":"pat-1","text":{"status":"generated","div":"<div>Anna</div>"},"name":[{"family":["Smith"]}],"gender":"female","telecom":[{"system":"phone","value":"555"}]}`))
+
+	decode := func(recorder *httptest.ResponseRecorder) map[string]any {
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d: %s", recorder.Code, recorder.Body.String())
+		}
+		var out map[string]any
+		if err := json.Unmarshal(recorder.Body.Bytes(), &out); err != nil {
+			t.Fatalf("decode response failed: %v", err)
+		}
+		return out
+	}
+	keys := func(resource map[string]any) string {
+		out := []string{}
+		for key := range resource {
+			out = append(out, key)
+		}
+		sort.Strings(out)
+		return strings.Join(out, ",")
+	}
+	subsetted := func(resource map[string]any) bool {
+		meta, _ := resource["meta"].(map[string]any)
+		tags, _ := meta["tag"].([]any)
+		for _, tag := range tags {
+			if coding, _ := tag.(map[string]any); coding["code"] == "SUBSETTED" {
+				return true
+			}
+		}
+		return false
+	}
+
+	elements := decode(performRequest(e, http.MethodGet, "/Patient/pat-1?_elements=name", nil))
+	if keys(elements) != "id,meta,name,resourceType" || !subsetted(elements) {
+		t.Fatalf("expected only name with a SUBSETTED tag, got %v", elements)
+	}
+	text := decode(performRequest(e, http.MethodGet, "/Patient/pat-1?_summary=text", nil))
+	if keys(text) != "id,meta,resourceType,text" {
+		t.Fatalf("expected only text, got %v", text)
+	}
+	full := decode(performRequest(e, http.MethodGet, "/Patient/pat-1", nil))
+	if subsetted(full) || full["text"] == nil {
+		t.Fatalf("expected full resource without SUBSETTED tag, got %v", full)
+	}
+
+	summary := decode(performRequest(e, http.MethodGet, "/Patient?_summary=true", nil))
+	entries, _ := summary["entry"].([]any)
+	if len(entries) != 1 {
+		t.Fatalf("expected 1 entry, got %v", summary)
+	}
+	resource := entries[0].(map[string]any)["resource"].(map[string]any)
+	if resource["text"] != nil || resource["gender"] != "female" || !subsetted(resource) {
+		t.Fatalf("expected summary elements only, got %v", resource)
+	}
+
+	count := decode(performRequest(e, http.MethodGet, "/Patient?_summary=count", nil))
+	if keys(count) != "resourceType,total,type" || count["total"] != float64(1) {
+		t.Fatalf("expected only Bundle.total, got %v", count)
+	}
+	none := decode(performRequest(e, http.MethodGet, "/Organization?_summary=count", nil))
+	if none["total"] != float64(0) {
+		t.Fatalf("expected total 0 to be present, got %v", none)
+	}
+
+	if recorder := performRequest(e, http.MethodGet, "/Patient/pat-1?_summary=bogus", nil); recorder.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for invalid _summary, got %d", recorder.Code)
+	}
+
+	for _, id := range []string{"pat-2", "pat-3"} {
+		performRequest(e, http.MethodPut, "/Patient/"+id, []byte(`{"resourceType":"Patient","id":"`+id+`","name":[{"family":["Smith"]}],"gender":"male"}`))
+	}
+	next := ""
+	for _, link := range decode(performRequest(e, http.MethodGet, "/Patient?_elements=gender&_count=2", nil))["link"].([]any) {
+		if link := link.(map[string]any); link["relation"] == "next" {
+			next = strings.TrimPrefix(link["url"].(string), "http://example.com")
+		}
+	}
+	if next == "" {
+		t.Fatalf("expected a next link")
+	}
+	page := decode(performRequest(e, http.MethodGet, next, nil))
+	entries, _ = page["entry"].([]any)
+	if len(entries) != 1 {
+		t.Fatalf("expected 1 entry on the next page, got %v", page)
+	}
+	resource = entries[0].(map[string]any)["resource"].(map[string]any)
+	if resource["name"] != nil || resource["gender"] == nil || !subsetted(resource) {
+		t.Fatalf("expected next page shaped by _elements, got %v", resource)
+	}
+}
+
+func TestPostSearchMatchesGet(t *testing.T) {
+	e, _ := setupTestServer()
+	performRequest(e, http.MethodPut, "/Patient/pat-1", []byte(`{"resourceType":"Patient","id":"pat-1","name":[{"family":["Smith"]}],"gender":"female"}`))
+	performRequest(e, http.MethodPut, "/Patient/pat-2", []byte(`{"resourceType":"Patient","id":"pat-2","name":[{"family":["Smithers"]}],"gender":"male"}`))
+	performRequest(e, http.MethodPut, "/Patient/pat-3", []byte(`{"resourceType":"Patient","id":"pat-3","name":[{"family":["Jones"]}]}`))
+
+	get := performRequest(e, http.MethodGet, "/Patient?family=smith&_sort=-gender", nil)
+	request := httptest.NewRequest(http.MethodPost, "/Patient/_search?_sort=-gender", strings.NewReader("family=smith"))
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	post := httptest.NewRecorder()
+	e.ServeHTTP(post, request)
+
+	if get.Code != http.StatusOK || post.Code != http.StatusOK {
+		t.Fatalf("expected 200 for both searches, got GET %d and POST %d: %s", get.Code, post.Code, post.Body.String())
+	}
+	var getBundle, postBundle struct {
+		Link []struct {
+			Relation string `json:"relation"`
+			URL      string `json:"url"`
+		} `json:"link"`
+		Entry json.RawMessage `json:"entry"`
+	}
+	if err := json.Unmarshal(get.Body.Bytes(), &getBundle); err != nil {
+		t.Fatalf("decode GET bundle failed: %v", err)
+	}
+	if err := json.Unmarshal(post.Body.Bytes(), &postBundle); err != nil {
+		t.Fatalf("decode POST bundle failed: %v", err)
+	}
+	if string(getBundle.Entry) != string(postBundle.Entry) {
+		t.Fatalf("expected identical entries, got\nGET  %s\nPOST %s", getBundle.Entry, postBundle.Entry)
+	}
+	if !strings.Contains(post.Body.String(), `"id":"pat-2"`) || strings.Contains(post.Body.String(), `"id":"pat-3"`) {
+		t.Fatalf("expected form criteria to filter results, got %s", post.Body.String())
+	}
+	if self := postBundle.Link[0].URL; self != "http://example.com/Patient?_sort=-gender" {
+		t.Fatalf("expected the POST self link to leave out the form criteria, got %q", self)
+	}
+
+	request = httptest.NewRequest(http.MethodPost, "/Patient/_search", strings.NewReader("family=smith&_count=1"))
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	post = httptest.NewRecorder()
+	e.ServeHTTP(post, request)
+	if err := json.Unmarshal(post.Body.Bytes(), &postBundle); err != nil {
+		t.Fatalf("decode paged POST bundle failed: %v", err)
+	}
+	for _, link := range postBundle.Link {
+		if strings.Contains(link.URL, "family") || !strings.Contains(link.URL, search.PagesParam) {
+			t.Fatalf("expected %s link to carry only the page token, got %q", link.Relation, link.URL)
+		}
+	}
+
+	if recorder := performRequest(e, http.MethodPost, "/Patient/_search", []byte(`{}`)); recorder.Code != http.StatusUnsupportedMediaType {
+		t.Fatalf("expected 415 for a JSON search body, got %d", recorder.Code)
+	}
+}
+
+func TestUnknownSearchParametersAreIgnored(t *testing.T) {
+	e, _ := setupTestServer()
+	performRequest(e, http.MethodPut, "/Patient/pat-1", []byte(`{"resourceType":"Patient","id":"pat-1","gender":"female"}`))
+	performRequest(e, http.MethodPut, "/Patient/pat-2", []byte(`{"resourceType":"Patient","id":"pat-2","gender":"male"}`))
+
+	recorder := performRequest(e, http.MethodGet, "/Patient?gender=female&foo=bar", nil)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+	var result struct {
+		Total int `json:"total"`
+		Link  []struct {
+			URL string `json:"url"`
+		} `json:"link"`
+	}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &result); err != nil {
+		t.Fatalf("decode search bundle failed: %v", err)
+	}
+	if result.Total != 1 || result.Link[0].URL != "http://example.com/Patient?gender=female" {
+		t.Fatalf("expected foo to be ignored and left out of the self link, got %+v", result)
+	}
+	if recorder := performRequest(e, http.MethodGet, "/?foo=bar", nil); recorder.Code != http.StatusOK {
+		t.Fatalf("expected 200 for a system search with an unknown parameter, got %d", recorder.Code)
+	}
+
+	request := httptest.NewRequest(http.MethodGet, "/Patient?foo=bar", nil)
+	request.Header.Set("Prefer", "return=representation, handling=strict")
+	strict := httptest.NewRecorder()
+	e.ServeHTTP(strict, request)
+	if strict.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 with strict handling, got %d", strict.Code)
+	}
+	if recorder := performRequest(e, http.MethodDelete, "/Patient?foo=bar", nil); recorder.Code != http.StatusBadRequest {
+		t.Fatalf("expected conditional delete to reject an unknown parameter, got %d", recorder.Code)
+	}
+}
+
+func TestSystemSearchAcrossTypes(t *testing.T) {
+	e, _ := setupTestServer()
+	performRequest(e, http.MethodPut, "/Patient/pat-1", []byte(`{"resourceType":"Patient","id":"pat-1","meta":{"tag":[{"system":"urn:sync","code":"batch-a"}]}}`))
+	performRequest(e, http.MethodPut, "/Practitioner/prac-1", []byte(`{"resourceType":"Practitioner","id":"prac-1"}`))
+	performRequest(e, http.MethodPost, "/_admin/clock/$advance?by=1h", nil)
+	checkpoint := performRequest(e, http.MethodGet, "/_admin/clock", nil)
+	var clock struct {
+		Now string `json:"now"`
+	}
+	if err := json.Unmarshal(checkpoint.Body.Bytes(), &clock); err != nil {
+		t.Fatalf("decode clock failed: %v", err)
+	}
+	performRequest(e, http.MethodPut, "/Practitioner/prac-2", []byte(`{"resourceType":"Practitioner","id":"prac-2"}`))
+	performRequest(e, http.MethodPut, "/Organization/org-1", []byte(`{"resourceType":"Organization","id":"org-1"}`))
+
+	search := func(target string) (int, string) {
+		recorder := performRequest(e, http.MethodGet, target, nil)
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("GET %s: expected 200, got %d: %s", target, recorder.Code, recorder.Body.String())
+		}
+		var out struct {
+			Total int `json:"total"`
+			Entry []struct {
+				Resource struct {
+					ResourceType string `json:"resourceType"`
+					ID           string `json:"id"`
+				} `json:"resource"`
+			} `json:"entry"`
+		}
+		if err := json.Unmarshal(recorder.Body.Bytes(), &out); err != nil {
+			t.Fatalf("decode search bundle failed: %v", err)
+		}
+		keys := []string{}
+		for _, entry := range out.Entry {
+			keys = append(keys, entry.Resource.ResourceType+"/"+entry.Resource.ID)
+		}
+		return out.Total, strings.Join(keys, ",")
+	}
+
+	if total, keys := search("/"); total != 4 || keys != "Organization/org-1,Patient/pat-1,Practitioner/prac-1,Practitioner/prac-2" {
+		t.Fatalf("expected every resource, got %d %s", total, keys)
+	}
+	if total, keys := search("/?_type=Patient,Practitioner&_lastUpdated=" + url.QueryEscape("ge"+clock.Now)); total != 1 || keys != "Practitioner/prac-2" {
+		t.Fatalf("expected only changes since the checkpoint, got %d %s", total, keys)
+	}
+	if _, keys := search("/?_tag=urn:sync|batch-a"); keys != "Patient/pat-1" {
+		t.Fatalf("expected _tag to match across types, got %s", keys)
+	}
+	if _, keys := search("/?_id=prac-1,org-1&_sort=-_id"); keys != "Practitioner/prac-1,Organization/org-1" {
+		t.Fatalf("expected _id and _sort across types, got %s", keys)
+	}
+	if recorder := performRequest(e, http.MethodGet, "/?_type=Unicorn", nil); recorder.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for an unknown _type, got %d", recorder.Code)
+	}
+	if recorder := performRequest(e, http.MethodGet, "/Patient?_type=Observation", nil); recorder.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for _type on a type-level search, got %d", recorder.Code)
+	}
+	if recorder := performRequest(e, http.MethodGet, "/?family=smith", nil); recorder.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for a parameter not shared by every type, got %d", recorder.Code)
+	}
+}
+
+func TestPatientCompartmentAndEverything(t *testing.T) {
+	e, _ := setupTestServer()
+	performRequest(e, http.MethodPut, "/Patient/pat-1", []byte(`{"resourceType":"Patient","id":"pat-1"}`))
+	performRequest(e, http.MethodPut, "/Patient/pat-2", []byte(`{"resourceType":"Patient","id":"pat-2"}`))
+	performRequest(e, http.MethodPut, "/Observation/obs-1", []byte(`{"resourceType":"Observation","id":"obs-1","status":"final","subject":{"reference":"Patient/pat-1"}}`))
+	performRequest(e, http.MethodPut, "/Observation/obs-2", []byte(`{"resourceType":"Observation","id":"obs-2","status":"final","subject":{"reference":"Patient/pat-2"}}`))
+	performRequest(e, http.MethodPut, "/Flag/flag-1", []byte(`{"resourceType":"Flag","id":"flag-1","status":"active","subject":{"reference":"Patient/pat-1"}}`))
+	performRequest(e, http.MethodPut, "/Consent/con-1", []byte(`{"resourceType":"Consent","id":"con-1","status":"active","patient":{"reference":"Patient/pat-1"}}`))
+	performRequest(e, http.MethodPost, "/_admin/clock/$advance?by=1h", nil)
+	checkpoint := performRequest(e, http.MethodGet, "/_admin/clock", nil)
+	var clock struct {
+		Now string `json:"now"`
+	}
+	if err := json.Unmarshal(checkpoint.Body.Bytes(), &clock); err != nil {
+		t.Fatalf("decode clock failed: %v", err)
+	}
+	performRequest(e, http.MethodPut, "/Task/task-1", []byte(`{"resourceType":"Task","id":"task-1","status":"ready","for":{"reference":"Patient/pat-1"}}`))
+	performRequest(e, http.MethodPut, "/AdvanceDirective/ad-1", []byte(`{"resourceType":"AdvanceDirective","id":"ad-1","patient":{"reference":"Patient/pat-1"}}`))
+
+	search := func(target string) (int, string, []string) {
+		recorder := performRequest(e, http.MethodGet, target, nil)
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("GET %s: expected 200, got %d: %s", target, recorder.Code, recorder.Body.String())
+		}
+		var out struct {
+			Total int `json:"total"`
+			Link  []struct {
+				Relation string `json:"relation"`
+			} `json:"link"`
+			Entry []struct {
+				Resource struct {
+					ResourceType string `json:"resourceType"`
+					ID           string `json:"id"`
+				} `json:"resource"`
+			} `json:"entry"`
+		}
+		if err := json.Unmarshal(recorder.Body.Bytes(), &out); err != nil {
+			t.Fatalf("decode search bundle failed: %v", err)
+		}
+		keys, relations := []string{}, []string{}
+		for _, entry := range out.Entry {
+			keys = append(keys, entry.Resource.ResourceType+"/"+entry.Resource.ID)
+		}
+		for _, link := range out.Link {
+			relations = append(relations, link.Relation)
+		}
+		return out.Total, strings.Join(keys, ","), relations
+	}
+
+	if total, keys, _ := search("/Patient/pat-1/Observation?status=final"); total != 1 || keys != "Observation/obs-1" {
+		t.Fatalf("expected only pat-1's observation, got %d %s", total, keys)
+	}
+	if total, keys, _ := search("/Patient/pat-1/$everything"); total != 6 || keys != "Patient/pat-1,AdvanceDirective/ad-1,Consent/con-1,Flag/flag-1,Observation/obs-1,Task/task-1" {
+		t.Fatalf("expected the patient followed by its compartment, got %d %s", total, keys)
+	}
+	if _, keys, _ := search("/Patient/pat-1/$everything?_type=Flag,Task"); keys != "Flag/flag-1,Task/task-1" {
+		t.Fatalf("expected _type to limit $everything, got %s", keys)
+	}
+	if _, keys, _ := search("/Patient/pat-1/$everything?_since=" + url.QueryEscape(clock.Now)); keys != "AdvanceDirective/ad-1,Task/task-1" {
+		t.Fatalf("expected _since to limit $everything, got %s", keys)
+	}
+	if total, _, relations := search("/Patient/pat-1/$everything?_count=2"); total != 6 || !strings.Contains(strings.Join(relations, ","), "next") {
+		t.Fatalf("expected a paged $everything with a next link, got %d %v", total, relations)
+	}
+	if recorder := performRequest(e, http.MethodGet, "/Patient/missing/$everything", nil); recorder.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for an unknown patient, got %d", recorder.Code)
+	}
+	if recorder := performRequest(e, http.MethodGet, "/Patient/pat-1/Practitioner", nil); recorder.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for a type outside the compartment, got %d", recorder.Code)
+	}
+}
+
+func TestCustomSearchParameterResource(t *testing.T) {
+	e, _ := setupTestServer()
+	performRequest(e, http.MethodPut, "/Patient/pat-1", []byte(`{"resourceType":"Patient","id":"pat-1","extension":[{"url":"http://example.org/fhir/birth-place","valueString":"Lyon"}]}`))
+	definition := `{"resourceType":"SearchParameter","url":"http://example.org/fhir/SearchParameter/birth-place","name":"BirthPlace","status":"active","code":"birth-place","base":["Patient"],"type":"string","description":"Place of birth","expression":"Patient.extension('http://example.org/fhir/birth-place').value as string"}`
+	if recorder := performRequest(e, http.MethodPost, "/SearchParameter", []byte(definition)); recorder.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+	performRequest(e, http.MethodPut, "/Patient/pat-2", []byte(`{"resourceType":"Patient","id":"pat-2","extension":[{"url":"http://example.org/fhir/birth-place","valueString":"Paris"}]}`))
+
+	recorder := performRequest(e, http.MethodGet, "/Patient?birth-place=par", nil)
+	var found struct {
+		Entry []struct {
+			Resource struct {
+				ID string `json:"id"`
+			} `json:"resource"`
+		} `json:"entry"`
+	}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &found); err != nil {
+		t.Fatalf("decode search bundle failed: %v", err)
+	}
+	if recorder.Code != http.StatusOK || len(found.Entry) != 1 || found.Entry[0].Resource.ID != "pat-2" {
+		t.Fatalf("expected pat-2 from the custom parameter, got %d %s", recorder.Code, recorder.Body.String())
+	}
+
+	if recorder := performRequest(e, http.MethodPost, "/SearchParameter", []byte(definition)); recorder.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("expected 422 for a duplicate code, got %d", recorder.Code)
+	}
+	invalid := strings.Replace(definition, "value as string", "value.first()", 1)
+	if recorder := performRequest(e, http.MethodPut, "/SearchParameter/broken", []byte(invalid)); recorder.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("expected 422 for an unsupported expression, got %d", recorder.Code)
+	}
+
+	metadata := performRequest(e, http.MethodGet, "/metadata", nil)
+	var capability struct {
+		Rest []struct {
+			Resource []struct {
+				Type        string              `json:"type"`
+				SearchParam []map[string]string `json:"searchParam"`
+			} `json:"resource"`
+		} `json:"rest"`
+	}
+	if err := json.Unmarshal(metadata.Body.Bytes(), &capability); err != nil {
+		t.Fatalf("decode capability statement failed: %v", err)
+	}
+	advertised := map[string]bool{}
+	for _, resource := range capability.Rest[0].Resource {
+		for _, param := range resource.SearchParam {
+			if param["name"] == "birth-place" {
+				advertised[resource.Type] = param["type"] == "string" && param["definition"] == "http://example.org/fhir/SearchParameter/birth-place"
+			}
+		}
+	}
+	if len(advertised) != 1 || !advertised["Patient"] {
+		t.Fatalf("expected birth-place advertised for Patient only, got %v", advertised)
+	}
+}
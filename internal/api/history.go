@@ -0,0 +1,225 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+
+	"mini-fhir/internal/bundle"
+	"mini-fhir/internal/fhir/dstu3"
+	"mini-fhir/internal/search"
+	"mini-fhir/internal/store"
+	"mini-fhir/internal/validation"
+)
+
+func (s *Server) handleHistory(c echo.Context) error {
+	versions, err := s.Store.History(c.Param("type"), c.Param("id"))
+	if err != nil {
+		return c.JSON(http.StatusNotFound, validation.NewOutcomeIssue("error", "not-found", err.Error()))
+	}
+	return s.historyResponse(c, versions)
+}
+
+func (s *Server) handleTypeHistory(c echo.Context) error {
+	resourceType := c.Param("type")
+	if _, ok := s.Registry.Info(resourceType); !ok {
+		return c.JSON(http.StatusNotFound, validation.NewOutcomeIssue("error", "not-found", "resource type not supported"))
+	}
+	return s.historyResponse(c, s.Store.TypeHistory(resourceType))
+}
+
+func (s *Server) handleSystemHistory(c echo.Context) error {
+	return s.historyResponse(c, s.Store.SystemHistory())
+}
+
+// historyResponse returns versions, newest first, as a history bundle.
+// _count pages the bundle with links that carry _getpagesoffset; versions
+// written between requests shift later pages.
+func (s *Server) historyResponse(c echo.Context, versions []*store.ResourceVersion) error {
+	query := c.QueryParams()
+	created := createdVersions(versions)
+	versions, err := filterHistory(versions, query)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, validation.NewOutcomeIssue("error", "invalid", err.Error()))
+	}
+	total := len(versions)
+	offset := 0
+	if raw := query.Get(search.PagesOffsetParam); raw != "" {
+		if offset, err = strconv.Atoi(raw); err != nil || offset < 0 {
+			return c.JSON(http.StatusBadRequest, validation.NewOutcomeIssue("error", "invalid", fmt.Sprintf("invalid %s value", search.PagesOffsetParam)))
+		}
+	}
+	versions = versions[min(offset, total):]
+	historyBundle := bundle.NewHistoryBundle(total)
+	if countParam := query.Get("_count"); countParam != "" {
+		count, err := strconv.Atoi(countParam)
+		if err != nil || count < 0 {
+			return c.JSON(http.StatusBadRequest, validation.NewOutcomeIssue("error", "invalid", "invalid _count value"))
+		}
+		if count < len(versions) {
+			versions = versions[:count]
+		}
+		if count > 0 {
+			historyBundle.Link = historyLinks(c, query, offset, count, total)
+		}
+	}
+	for _, version := range versions {
+		historyBundle.Entry = append(historyBundle.Entry, historyEntry(c, version, created[version]))
+	}
+	return c.JSON(http.StatusOK, historyBundle)
+}
+
+func historyLinks(c echo.Context, query url.Values, offset, count, total int) []bundle.Link {
+	base := fmt.Sprintf("%s://%s%s", c.Scheme(), c.Request().Host, c.Request().URL.Path)
+	self := base
+	if len(query) > 0 {
+		self += "?" + query.Encode()
+	}
+	pageURL := func(offset int) string {
+		page := url.Values{}
+		for key, values := range query {
+			page[key] = values
+		}
+		page.Set(search.PagesOffsetParam, strconv.Itoa(offset))
+		return base + "?" + page.Encode()
+	}
+	return pageLinks(self, pageURL, offset, count, total)
+}
+
+// filterHistory applies _since and _at to versions, which must be ordered
+// newest first; the order is preserved.
+func filterHistory(versions []*store.ResourceVersion, query url.Values) ([]*store.ResourceVersion, error) {
+	since, at := query.Get("_since"), query.Get("_at")
+	if since == "" && at == "" {
+		return versions, nil
+	}
+	var sinceStart, atStart, atEnd time.Time
+	var err error
+	if since != "" {
+		if sinceStart, _, err = dstu3.ParseDateRange(since); err != nil {
+			return nil, fmt.Errorf("invalid _since: %w", err)
+		}
+	}
+	if at != "" {
+		if atStart, atEnd, err = dstu3.ParseDateRange(at); err != nil {
+			return nil, fmt.Errorf("invalid _at: %w", err)
+		}
+	}
+
+	validTo := supersededAt(versions)
+	filtered := make([]*store.ResourceVersion, 0, len(versions))
+	for _, version := range versions {
+		updated, err := time.Parse(time.RFC3339Nano, version.LastUpdated)
+		if err != nil {
+			continue
+		}
+		if since != "" && updated.Before(sinceStart) {
+			continue
+		}
+		if at != "" {
+			if version.Deleted || !updated.Before(atEnd) {
+				continue
+			}
+			if end, ok := validTo[version]; ok && !end.After(atStart) {
+				continue
+			}
+		}
+		filtered = append(filtered, version)
+	}
+	return filtered, nil
+}
+
+// supersededAt maps each version to the time the next version of the same
+// resource replaced it. Current versions are absent from the map.
+func supersededAt(versions []*store.ResourceVersion) map[*store.ResourceVersion]time.Time {
+	out := map[*store.ResourceVersion]time.Time{}
+	for _, chain := range versionChains(versions) {
+		for i := 0; i+1 < len(chain); i++ {
+			if next, err := time.Parse(time.RFC3339Nano, chain[i+1].LastUpdated); err == nil {
+				out[chain[i]] = next
+			}
+		}
+	}
+	return out
+}
+
+// createdVersions marks the versions that created their resource: the
+// first version, and any version written over a tombstone.
+func createdVersions(versions []*store.ResourceVersion) map[*store.ResourceVersion]bool {
+	out := map[*store.ResourceVersion]bool{}
+	for _, chain := range versionChains(versions) {
+		for i, version := range chain {
+			if version.Deleted {
+				continue
+			}
+			if version.VersionID == "1" || (i > 0 && chain[i-1].Deleted) {
+				out[version] = true
+			}
+		}
+	}
+	return out
+}
+
+// versionChains groups versions by resource, oldest version first.
+func versionChains(versions []*store.ResourceVersion) map[string][]*store.ResourceVersion {
+	chains := map[string][]*store.ResourceVersion{}
+	for _, version := range versions {
+		key := version.ResourceType + "/" + version.ID
+		chains[key] = append(chains[key], version)
+	}
+	for _, chain := range chains {
+		sort.SliceStable(chain, func(i, j int) bool {
+			left, _ := strconv.Atoi(chain[i].VersionID)
+			right, _ := strconv.Atoi(chain[j].VersionID)
+			return left < right
+		})
+	}
+	return chains
+}
+
+func historyEntry(c echo.Context, version *store.ResourceVersion, created bool) bundle.Entry {
+	instanceURL := version.ResourceType + "/" + version.ID
+	entry := bundle.Entry{
+		FullURL: fmt.Sprintf("%s://%s/%s", c.Scheme(), c.Request().Host, instanceURL),
+		Response: &bundle.EntryResponse{
+			Etag:         fmt.Sprintf(`W/"%s"`, version.VersionID),
+			LastModified: version.LastUpdated,
+		},
+	}
+	method := version.Method
+	if method == "" {
+		// Versions written before the store recorded methods.
+		switch {
+		case version.Deleted:
+			method = store.MethodDelete
+		case version.VersionID == "1":
+			method = store.MethodCreate
+		default:
+			method = store.MethodUpdate
+		}
+	}
+	switch {
+	case method == store.MethodDelete:
+		entry.Request = &bundle.EntryRequest{Method: http.MethodDelete, URL: instanceURL}
+		entry.Response.Status = "204"
+	case method == store.MethodCreate:
+		entry.Resource = version.Resource
+		entry.Request = &bundle.EntryRequest{Method: http.MethodPost, URL: version.ResourceType}
+		entry.Response.Status = "201"
+		entry.Response.Location = instanceURL + "/_history/" + version.VersionID
+	default:
+		entry.Resource = version.Resource
+		entry.Request = &bundle.EntryRequest{Method: http.MethodPut, URL: instanceURL}
+		entry.Response.Status = "200"
+		if created {
+			entry.Response.Status = "201"
+			entry.Response.Location = instanceURL + "/_history/" + version.VersionID
+		}
+	}
+	return entry
+}
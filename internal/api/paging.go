@@ -0,0 +1,73 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+
+	"mini-fhir/internal/bundle"
+	"mini-fhir/internal/search"
+)
+
+// searchLinks builds the self link from the search parameters and, for
+// results that span several pages, first/previous/next/last links into the
+// result snapshot. POST searches keep their criteria out of URLs: self
+// carries only the request's own query string, or the page token once the
+// results are paged. Page links repeat _summary and _elements so every
+// page is shaped like the first.
+func searchLinks(c echo.Context, path string, query url.Values, result *search.SearchResult) []bundle.Link {
+	base := fmt.Sprintf("%s://%s", c.Scheme(), c.Request().Host)
+	shaping := url.Values{}
+	for _, key := range []string{"_summary", "_elements"} {
+		if values, ok := query[key]; ok {
+			shaping[key] = values
+		}
+	}
+	post := c.Request().Method == http.MethodPost
+	if post {
+		query = c.QueryParams()
+	}
+	self := fmt.Sprintf("%s/%s", base, path)
+	if len(query) > 0 {
+		self += "?" + query.Encode()
+	}
+	if result.Token == "" || result.PageSize == 0 {
+		return []bundle.Link{{Relation: "self", URL: self}}
+	}
+	pageURL := func(offset int) string {
+		query := url.Values{}
+		for key, values := range shaping {
+			query[key] = values
+		}
+		query.Set(search.PagesParam, result.Token)
+		query.Set(search.PagesOffsetParam, strconv.Itoa(offset))
+		query.Set("_count", strconv.Itoa(result.PageSize))
+		return fmt.Sprintf("%s/%s?%s", base, path, query.Encode())
+	}
+	if post {
+		self = pageURL(result.Offset)
+	}
+	return pageLinks(self, pageURL, result.Offset, result.PageSize, result.Count)
+}
+
+// pageLinks returns self plus first/previous/next/last links for the page
+// of pageSize entries at offset in a list of count entries.
+func pageLinks(self string, pageURL func(offset int) string, offset, pageSize, count int) []bundle.Link {
+	links := []bundle.Link{{Relation: "self", URL: self}}
+	links = append(links, bundle.Link{Relation: "first", URL: pageURL(0)})
+	if offset > 0 {
+		links = append(links, bundle.Link{Relation: "previous", URL: pageURL(max(offset-pageSize, 0))})
+	}
+	if offset+pageSize < count {
+		links = append(links, bundle.Link{Relation: "next", URL: pageURL(offset + pageSize)})
+	}
+	last := 0
+	if count > 0 {
+		last = (count - 1) / pageSize * pageSize
+	}
+	links = append(links, bundle.Link{Relation: "last", URL: pageURL(last)})
+	return links
+}
@@ -2,6 +2,7 @@ package api
 
 import (
 	"net/http"
+	"sync"
 
 	"github.com/labstack/echo/v4"
 
@@ -14,30 +15,90 @@ import (
 type Server struct {
 	Registry  *dstu3.Registry
 	Validator *validation.Validator
-	Store     *store.Store
+	Store     store.Store
 	Searcher  *search.Searcher
+	IDs       store.IDGenerator
+	Snapshots *store.Snapshots
+	Clock     *store.AdjustableClock
+
+	// sequence is set when ids come from WithSequenceIDs; restoring a
+	// snapshot resets it.
+	sequence *store.Sequence
+	// writeMu orders writes: plain writes share it and conditional
+	// operations hold it alone, so no write lands between a conditional
+	// operation's search and its write.
+	writeMu sync.RWMutex
+}
+
+type Option func(*Server)
+
+func WithClock(clock *store.AdjustableClock) Option {
+	return func(s *Server) {
+		s.Clock = clock
+	}
+}
+
+func WithSnapshots(snapshots *store.Snapshots) Option {
+	return func(s *Server) {
+		s.Snapshots = snapshots
+	}
 }
 
-func RegisterRoutes(e *echo.Echo, registry *dstu3.Registry, validator *validation.Validator, store *store.Store, searcher *search.Searcher) {
+func WithIDGenerator(ids store.IDGenerator) Option {
+	return func(s *Server) {
+		s.IDs = ids
+	}
+}
+
+// WithSequenceIDs numbers created resources per type, continuing from the
+// highest numeric id already in the store.
+func WithSequenceIDs() Option {
+	return func(s *Server) {
+		s.sequence = store.NewSequence(s.Store)
+		s.IDs = s.sequence.Next
+	}
+}
+
+func RegisterRoutes(e *echo.Echo, registry *dstu3.Registry, validator *validation.Validator, resourceStore store.Store, searcher *search.Searcher, opts ...Option) {
 	s := &Server{
 		Registry:  registry,
 		Validator: validator,
-		Store:     store,
+		Store:     resourceStore,
 		Searcher:  searcher,
+		IDs:       store.UUIDGenerator(),
+		Snapshots: store.NewSnapshots(resourceStore, registry, ""),
+	}
+	for _, opt := range opts {
+		opt(s)
 	}
 
 	e.GET("/metadata", s.handleMetadata)
 	e.POST("/$validate", s.handleValidate)
 	e.POST("/:type/$validate", s.handleValidate)
 
+	e.GET("/_admin/snapshots", s.handleListSnapshots)
+	e.POST("/_admin/snapshots/:name", s.handleSaveSnapshot)
+	e.POST("/_admin/snapshots/:name/$restore", s.handleRestoreSnapshot)
+	e.DELETE("/_admin/snapshots/:name", s.handleDeleteSnapshot)
+	e.GET("/_admin/clock", s.handleClock)
+	e.POST("/_admin/clock/:operation", s.handleClockOperation)
+
+	e.GET("/", s.handleSystemSearch)
 	e.POST("/", s.handleBatchTransaction)
 	e.POST("/:type", s.handleCreate)
 	e.GET("/:type/:id", s.handleRead)
 	e.PUT("/:type/:id", s.handleUpdate)
 	e.DELETE("/:type/:id", s.handleDelete)
 	e.GET("/:type/:id/_history", s.handleHistory)
+	e.GET("/:type/:id/_history/:vid", s.handleVRead)
+	e.GET("/:type/:id/$everything", s.handleEverything)
+	e.GET("/:type/:id/:compartmentType", s.handleCompartmentSearch)
+	e.GET("/:type/_history", s.handleTypeHistory)
 	e.GET("/_history", s.handleSystemHistory)
 	e.GET("/:type", s.handleSearch)
+	e.POST("/:type/_search", s.handlePostSearch)
+	e.PUT("/:type", s.handleConditionalUpdate)
+	e.DELETE("/:type", s.handleConditionalDelete)
 
 	e.GET("/healthz", func(c echo.Context) error {
 		return c.NoContent(http.StatusOK)
@@ -0,0 +1,129 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"mini-fhir/internal/fhir/dstu3"
+)
+
+var subsettedTag = map[string]any{
+	"system":  "http://hl7.org/fhir/v3/ObservationValue",
+	"code":    "SUBSETTED",
+	"display": "subsetted",
+}
+
+// shaping is the _summary and _elements request for a response.
+type shaping struct {
+	summary  string
+	elements []string
+}
+
+func parseShaping(query url.Values) (shaping, error) {
+	out := shaping{summary: query.Get("_summary")}
+	switch out.summary {
+	case "", "false", "true", "text", "data", "count":
+	default:
+		return shaping{}, fmt.Errorf("invalid _summary value %q", out.summary)
+	}
+	for _, value := range query["_elements"] {
+		for _, element := range strings.Split(value, ",") {
+			if element = strings.TrimSpace(element); element != "" {
+				out.elements = append(out.elements, element)
+			}
+		}
+	}
+	if len(out.elements) > 0 && out.summary != "" && out.summary != "false" {
+		return shaping{}, fmt.Errorf("_summary and _elements cannot be combined")
+	}
+	return out, nil
+}
+
+func (sh shaping) active() bool {
+	return len(sh.elements) > 0 || (sh.summary != "" && sh.summary != "false")
+}
+
+// subsetResource is a resource with some elements removed. It marshals as
+// the remaining elements rather than the full typed resource.
+type subsetResource struct {
+	dstu3.Resource
+	raw map[string]any
+}
+
+func (r *subsetResource) MarshalJSON() ([]byte, error) {
+	return json.Marshal(r.raw)
+}
+
+// apply returns resource reduced to the requested elements and tagged
+// SUBSETTED, or resource itself when nothing is removed.
+func (sh shaping) apply(resource dstu3.Resource) (dstu3.Resource, error) {
+	if !sh.active() {
+		return resource, nil
+	}
+	data, err := json.Marshal(resource)
+	if err != nil {
+		return nil, err
+	}
+	var raw map[string]any
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+
+	keep := sh.keep(resource.GetResourceType())
+	removed := false
+	for key := range raw {
+		if key == "resourceType" || key == "id" || key == "meta" || keep(key) {
+			continue
+		}
+		delete(raw, key)
+		removed = true
+	}
+	if !removed {
+		return resource, nil
+	}
+
+	meta, _ := raw["meta"].(map[string]any)
+	if meta == nil {
+		meta = map[string]any{}
+	}
+	tags, _ := meta["tag"].([]any)
+	meta["tag"] = append(tags, subsettedTag)
+	raw["meta"] = meta
+	return &subsetResource{Resource: resource, raw: raw}, nil
+}
+
+func (sh shaping) keep(resourceType string) func(string) bool {
+	allowed := map[string]struct{}{}
+	for _, element := range dstu3.MandatoryElements(resourceType) {
+		allowed[element] = struct{}{}
+	}
+	switch {
+	case len(sh.elements) > 0:
+		for _, element := range sh.elements {
+			allowed[element] = struct{}{}
+		}
+	case sh.summary == "true":
+		for _, element := range dstu3.SummaryElements(resourceType) {
+			allowed[element] = struct{}{}
+		}
+	case sh.summary == "text":
+		allowed["text"] = struct{}{}
+	case sh.summary == "data":
+		return func(key string) bool { return key != "text" }
+	}
+	return func(key string) bool {
+		if _, ok := allowed[key]; ok {
+			return true
+		}
+		// A choice element such as "effective" selects effectiveDateTime,
+		// effectivePeriod and so on.
+		for element := range allowed {
+			if rest, ok := strings.CutPrefix(key, element); ok && rest != "" && rest[0] >= 'A' && rest[0] <= 'Z' {
+				return true
+			}
+		}
+		return false
+	}
+}
@@ -5,14 +5,21 @@ import "mini-fhir/internal/fhir/dstu3"
 type Bundle struct {
 	ResourceType string  `json:"resourceType"`
 	Type         string  `json:"type"`
-	Total        int     `json:"total,omitempty"`
+	Total        *int    `json:"total,omitempty"`
+	Link         []Link  `json:"link,omitempty"`
 	Entry        []Entry `json:"entry,omitempty"`
 }
 
+type Link struct {
+	Relation string `json:"relation"`
+	URL      string `json:"url"`
+}
+
 type Entry struct {
 	FullURL  string         `json:"fullUrl,omitempty"`
 	Resource dstu3.Resource `json:"resource,omitempty"`
 	Search   *EntrySearch   `json:"search,omitempty"`
+	Request  *EntryRequest  `json:"request,omitempty"`
 	Response *EntryResponse `json:"response,omitempty"`
 }
 
@@ -20,15 +27,31 @@ type EntrySearch struct {
 	Mode string `json:"mode,omitempty"`
 }
 
+type EntryRequest struct {
+	Method string `json:"method,omitempty"`
+	URL    string `json:"url,omitempty"`
+}
+
 type EntryResponse struct {
-	Status string `json:"status,omitempty"`
+	Status       string `json:"status,omitempty"`
+	Location     string `json:"location,omitempty"`
+	Etag         string `json:"etag,omitempty"`
+	LastModified string `json:"lastModified,omitempty"`
 }
 
 func NewSearchBundle(total int) *Bundle {
 	return &Bundle{
 		ResourceType: "Bundle",
 		Type:         "searchset",
-		Total:        total,
+		Total:        &total,
+	}
+}
+
+func NewHistoryBundle(total int) *Bundle {
+	return &Bundle{
+		ResourceType: "Bundle",
+		Type:         "history",
+		Total:        &total,
 	}
 }
 
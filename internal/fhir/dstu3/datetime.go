@@ -0,0 +1,57 @@
+package dstu3
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+var dateTimeLayouts = []struct {
+	layout string
+	step   func(time.Time) time.Time
+}{
+	{time.RFC3339Nano, nil},
+	{"2006-01-02T15:04:05", func(t time.Time) time.Time { return t.Add(time.Second) }},
+	{"2006-01-02T15:04", func(t time.Time) time.Time { return t.Add(time.Minute) }},
+	{"2006-01-02", func(t time.Time) time.Time { return t.AddDate(0, 0, 1) }},
+	{"2006-01", func(t time.Time) time.Time { return t.AddDate(0, 1, 0) }},
+	{"2006", func(t time.Time) time.Time { return t.AddDate(1, 0, 0) }},
+}
+
+// ParseDateRange parses a FHIR date, dateTime or instant and returns the
+// half-open interval [start, end) it covers at its stated precision, so
+// "2024-03" spans the whole month. Values without a zone are read as UTC.
+func ParseDateRange(value string) (time.Time, time.Time, error) {
+	value = strings.TrimSpace(value)
+	for _, candidate := range dateTimeLayouts {
+		parsed, err := time.Parse(candidate.layout, value)
+		if err != nil {
+			continue
+		}
+		if candidate.step != nil {
+			return parsed, candidate.step(parsed), nil
+		}
+		return parsed, parsed.Add(fractionUnit(value)), nil
+	}
+	return time.Time{}, time.Time{}, fmt.Errorf("invalid date: %q", value)
+}
+
+// fractionUnit is the precision of an RFC3339 timestamp's seconds field.
+func fractionUnit(value string) time.Duration {
+	dot := strings.IndexByte(value, '.')
+	if dot < 0 {
+		return time.Second
+	}
+	digits := 0
+	for _, r := range value[dot+1:] {
+		if r < '0' || r > '9' {
+			break
+		}
+		digits++
+	}
+	unit := time.Second
+	for i := 0; i < digits && unit > time.Nanosecond; i++ {
+		unit /= 10
+	}
+	return unit
+}
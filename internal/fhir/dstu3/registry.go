@@ -39,11 +39,15 @@ func NewRegistry() *Registry {
 	add("Observation", func() Resource { return &Observation{ResourceBase: ResourceBase{ResourceType: "Observation"}} }, "https://hl7.org/fhir/STU3/observation.profile.json")
 	add("Flag", func() Resource { return &Flag{ResourceBase: ResourceBase{ResourceType: "Flag"}} }, "https://hl7.org/fhir/STU3/flag.profile.json")
 	add("Consent", func() Resource { return &Consent{ResourceBase: ResourceBase{ResourceType: "Consent"}} }, "https://hl7.org/fhir/STU3/consent.profile.json")
+	// DSTU3 has no AdvanceDirective resource, so there is no base profile.
 	add("AdvanceDirective", func() Resource {
 		return &AdvanceDirective{ResourceBase: ResourceBase{ResourceType: "AdvanceDirective"}}
-	}, "https://hl7.org/fhir/STU3/advancedirective.profile.json")
+	}, "")
 	add("Location", func() Resource { return &Location{ResourceBase: ResourceBase{ResourceType: "Location"}} }, "https://hl7.org/fhir/STU3/location.profile.json")
 	add("Task", func() Resource { return &Task{ResourceBase: ResourceBase{ResourceType: "Task"}} }, "https://hl7.org/fhir/STU3/task.profile.json")
+	add("SearchParameter", func() Resource {
+		return &SearchParameter{ResourceBase: ResourceBase{ResourceType: "SearchParameter"}}
+	}, "https://hl7.org/fhir/STU3/searchparameter.profile.json")
 
 	return &Registry{resources: resources}
 }
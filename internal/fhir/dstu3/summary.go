@@ -0,0 +1,35 @@
+package dstu3
+
+// summaryElements lists the top-level elements marked isSummary in the
+// DSTU3 definitions, limited to those our models carry.
+var summaryElements = map[string][]string{
+	"Patient":          {"identifier", "name", "telecom", "gender", "birthDate", "address", "managingOrganization"},
+	"Practitioner":     {"identifier", "name", "telecom", "address"},
+	"PractitionerRole": {"practitioner", "organization", "location", "healthcareService"},
+	"Organization":     {"identifier", "name", "partOf"},
+	"Observation":      {"status", "code", "subject", "effectiveDateTime", "effectivePeriod", "issued", "performer"},
+	"Flag":             {"status", "category", "code", "subject", "encounter", "author"},
+	"Consent":          {"status", "patient", "organization", "sourceReference"},
+	"AdvanceDirective": {"patient", "author"},
+	"Location":         {"status", "name", "mode", "type", "address", "physicalType", "managingOrganization"},
+	"Task":             {"status", "intent", "priority", "description", "focus", "for", "requester", "owner", "executionPeriod", "basedOn"},
+	"SearchParameter":  {"url", "name", "status", "code", "base", "type"},
+}
+
+// mandatoryElements lists the top-level elements with a minimum
+// cardinality of one.
+var mandatoryElements = map[string][]string{
+	"Observation":     {"status", "code"},
+	"Flag":            {"status", "code", "subject"},
+	"Consent":         {"status", "patient"},
+	"Task":            {"status", "intent"},
+	"SearchParameter": {"url", "name", "status", "code", "base", "type", "description"},
+}
+
+func SummaryElements(resourceType string) []string {
+	return summaryElements[resourceType]
+}
+
+func MandatoryElements(resourceType string) []string {
+	return mandatoryElements[resourceType]
+}
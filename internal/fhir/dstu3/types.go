@@ -18,6 +18,7 @@ type ResourceBase struct {
 	Meta         *Meta             `json:"meta,omitempty"`
 	Text         *Narrative        `json:"text,omitempty"`
 	Contained    []json.RawMessage `json:"contained,omitempty"`
+	Extension    []Extension       `json:"extension,omitempty"`
 }
 
 func (r *ResourceBase) GetResourceType() string { return r.ResourceType }
@@ -48,6 +49,7 @@ type Meta struct {
 	VersionID   string   `json:"versionId,omitempty"`
 	LastUpdated string   `json:"lastUpdated,omitempty"`
 	Profile     []string `json:"profile,omitempty"`
+	Tag         []Coding `json:"tag,omitempty"`
 }
 
 type Narrative struct {
@@ -116,14 +118,22 @@ type ContactPoint struct {
 }
 
 type Extension struct {
-	URL          string      `json:"url,omitempty"`
-	ValueString  string      `json:"valueString,omitempty"`
-	ValueBoolean *bool       `json:"valueBoolean,omitempty"`
-	ValueCode    string      `json:"valueCode,omitempty"`
-	ValueCoding  *Coding     `json:"valueCoding,omitempty"`
-	ValuePeriod  *Period     `json:"valuePeriod,omitempty"`
-	ValueRef     *Reference  `json:"valueReference,omitempty"`
-	Extension    []Extension `json:"extension,omitempty"`
+	URL                  string           `json:"url,omitempty"`
+	ValueString          string           `json:"valueString,omitempty"`
+	ValueBoolean         *bool            `json:"valueBoolean,omitempty"`
+	ValueCode            string           `json:"valueCode,omitempty"`
+	ValueCoding          *Coding          `json:"valueCoding,omitempty"`
+	ValueCodeableConcept *CodeableConcept `json:"valueCodeableConcept,omitempty"`
+	ValueIdentifier      *Identifier      `json:"valueIdentifier,omitempty"`
+	ValueURI             string           `json:"valueUri,omitempty"`
+	ValueInteger         *int             `json:"valueInteger,omitempty"`
+	ValueDecimal         *float64         `json:"valueDecimal,omitempty"`
+	ValueQuantity        *Quantity        `json:"valueQuantity,omitempty"`
+	ValueDate            string           `json:"valueDate,omitempty"`
+	ValueDateTime        string           `json:"valueDateTime,omitempty"`
+	ValuePeriod          *Period          `json:"valuePeriod,omitempty"`
+	ValueRef             *Reference       `json:"valueReference,omitempty"`
+	Extension            []Extension      `json:"extension,omitempty"`
 }
 
 type Reference struct {
@@ -410,3 +420,21 @@ func (l *Location) References() []Reference {
 }
 
 func (l *Location) Clone() (Resource, error) { return cloneResource(*l) }
+
+// SearchParameter
+
+type SearchParameter struct {
+	ResourceBase
+	URL         string   `json:"url,omitempty"`
+	Name        string   `json:"name,omitempty"`
+	Status      string   `json:"status,omitempty"`
+	Code        string   `json:"code,omitempty"`
+	Base        []string `json:"base,omitempty"`
+	Type        string   `json:"type,omitempty"`
+	Description string   `json:"description,omitempty"`
+	Expression  string   `json:"expression,omitempty"`
+	Target      []string `json:"target,omitempty"`
+}
+
+func (p *SearchParameter) References() []Reference  { return nil }
+func (p *SearchParameter) Clone() (Resource, error) { return cloneResource(*p) }
@@ -0,0 +1,158 @@
+package search
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"mini-fhir/internal/fhir/dstu3"
+	"mini-fhir/internal/store"
+)
+
+// compartments follows the DSTU3 CompartmentDefinitions: for each
+// compartment type, the search parameters that place a resource of each
+// member type in the compartment. AdvanceDirective is our own type.
+var compartments = map[string]map[string][]string{
+	"Patient": {
+		"Observation":      {"subject", "performer"},
+		"Flag":             {"patient"},
+		"Consent":          {"patient"},
+		"Task":             {"for"},
+		"AdvanceDirective": {"patient"},
+	},
+}
+
+// everythingParams are the parameters $everything accepts.
+var everythingParams = map[string]struct{}{
+	"_since": {}, "_type": {}, "_count": {}, "_summary": {}, "_elements": {}, "_format": {}, "_pretty": {},
+}
+
+// CompartmentTypes returns the resource types in compartment, sorted.
+func (s *Searcher) CompartmentTypes(compartment string) []string {
+	out := []string{}
+	for resourceType := range compartments[compartment] {
+		if _, ok := s.paramTable()[resourceType]; ok {
+			out = append(out, resourceType)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// SearchCompartment searches resourceType within the compartment of
+// compartment/id, as in GET /Patient/123/Observation.
+func (s *Searcher) SearchCompartment(compartment, id, resourceType string, query url.Values) (*SearchResult, error) {
+	snapshotType := compartment + "/" + id + "/" + resourceType
+	if query.Get(PagesParam) != "" {
+		return s.Page(snapshotType, query)
+	}
+	if _, ok := compartments[compartment][resourceType]; !ok {
+		return nil, fmt.Errorf("%s is not in the %s compartment", resourceType, compartment)
+	}
+	entries, err := s.Match(resourceType, query)
+	if err != nil {
+		return nil, err
+	}
+	return s.results(snapshotType, []string{resourceType}, s.inCompartment(compartment, id, entries), query)
+}
+
+// Everything returns the patient and every resource in its compartment,
+// optionally limited by _type and _since.
+func (s *Searcher) Everything(id string, query url.Values) (*SearchResult, error) {
+	snapshotType := "Patient/" + id + "/$everything"
+	if query.Get(PagesParam) != "" {
+		return s.Page(snapshotType, query)
+	}
+	for key := range query {
+		if _, ok := everythingParams[key]; !ok {
+			return nil, fmt.Errorf("parameter %q is not supported by $everything", key)
+		}
+	}
+	patient, err := s.store.Get("Patient", id)
+	if err != nil {
+		return nil, err
+	}
+	var since time.Time
+	if raw := query.Get("_since"); raw != "" {
+		if since, _, err = dstu3.ParseDateRange(raw); err != nil {
+			return nil, fmt.Errorf("invalid _since: %w", err)
+		}
+	}
+	wanted, err := s.everythingTypes(query["_type"])
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []*store.ResourceEntry{}
+	if _, ok := wanted["Patient"]; ok {
+		entries = append(entries, patient)
+	}
+	for _, resourceType := range s.CompartmentTypes("Patient") {
+		if _, ok := wanted[resourceType]; !ok {
+			continue
+		}
+		listed, err := s.store.List(resourceType)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, s.inCompartment("Patient", id, listed)...)
+	}
+	if !since.IsZero() {
+		entries = updatedSince(entries, since)
+	}
+	return s.results(snapshotType, nil, entries, query)
+}
+
+func (s *Searcher) everythingTypes(values []string) (map[string]struct{}, error) {
+	allowed := append([]string{"Patient"}, s.CompartmentTypes("Patient")...)
+	wanted := map[string]struct{}{}
+	if len(values) == 0 {
+		for _, resourceType := range allowed {
+			wanted[resourceType] = struct{}{}
+		}
+		return wanted, nil
+	}
+	for _, value := range values {
+		for _, resourceType := range strings.Split(value, ",") {
+			resourceType = strings.TrimSpace(resourceType)
+			if resourceType != "Patient" {
+				if _, ok := compartments["Patient"][resourceType]; !ok {
+					return nil, fmt.Errorf("%s is not in the Patient compartment", resourceType)
+				}
+			}
+			wanted[resourceType] = struct{}{}
+		}
+	}
+	return wanted, nil
+}
+
+// inCompartment keeps the entries that refer to compartment/id through
+// one of the compartment's parameters for their type.
+func (s *Searcher) inCompartment(compartment, id string, entries []*store.ResourceEntry) []*store.ResourceEntry {
+	out := []*store.ResourceEntry{}
+	for _, entry := range entries {
+		resourceType := entry.Resource.GetResourceType()
+		tree := resourceTree(entry.Resource)
+		for _, code := range compartments[compartment][resourceType] {
+			param, ok := s.paramTable()[resourceType][code]
+			if ok && s.matchCriterion(tree, criterion{param: param, modifier: compartment, values: []string{id}}) {
+				out = append(out, entry)
+				break
+			}
+		}
+	}
+	return out
+}
+
+func updatedSince(entries []*store.ResourceEntry, since time.Time) []*store.ResourceEntry {
+	out := []*store.ResourceEntry{}
+	for _, entry := range entries {
+		updated, err := time.Parse(time.RFC3339Nano, entry.LastUpdated)
+		if err == nil && !updated.Before(since) {
+			out = append(out, entry)
+		}
+	}
+	return out
+}
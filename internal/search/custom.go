@@ -0,0 +1,142 @@
+package search
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"mini-fhir/internal/fhir/dstu3"
+)
+
+// CheckSearchParameter reports whether resource is a SearchParameter the
+// searcher can index: its expression compiles for every base type and its
+// code is not already taken by a built-in or another SearchParameter.
+func (s *Searcher) CheckSearchParameter(resource dstu3.Resource) error {
+	compiled, err := s.compileSearchParameter(resource)
+	if err != nil {
+		return err
+	}
+	s.syncCustomParams()
+	s.mu.RLock()
+	owners := s.owners
+	s.mu.RUnlock()
+
+	resourceTypes := make([]string, 0, len(compiled))
+	for resourceType := range compiled {
+		resourceTypes = append(resourceTypes, resourceType)
+	}
+	sort.Strings(resourceTypes)
+	for _, resourceType := range resourceTypes {
+		code := compiled[resourceType].Code
+		if _, ok := s.builtin[resourceType][code]; ok {
+			return fmt.Errorf("search parameter %q is already defined for %s", code, resourceType)
+		}
+		if owner, ok := owners[resourceType+"/"+code]; ok && owner != resource.GetID() {
+			return fmt.Errorf("search parameter %q for %s is already defined by SearchParameter/%s", code, resourceType, owner)
+		}
+	}
+	return nil
+}
+
+// paramTable returns the current parameter table. A published table is
+// never modified.
+func (s *Searcher) paramTable() map[string]map[string]SearchParam {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.params
+}
+
+// syncCustomParams rebuilds the parameter table when the stored
+// SearchParameter resources have changed since it was last built, so
+// parameters created, updated, deleted, seeded or restored take effect on
+// the next search. Entries that no longer compile, or whose code is taken,
+// are skipped; earlier ids win.
+func (s *Searcher) syncCustomParams() {
+	entries, err := s.store.List("SearchParameter")
+	if err != nil {
+		return
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Resource.GetID() < entries[j].Resource.GetID() })
+	versions := make([]string, len(entries))
+	for i, entry := range entries {
+		versions[i] = entry.Resource.GetID() + "/" + entry.VersionID
+	}
+	key := strings.Join(versions, ",")
+	s.mu.RLock()
+	current := s.customKey
+	s.mu.RUnlock()
+	if key == current {
+		return
+	}
+
+	params := make(map[string]map[string]SearchParam, len(s.builtin))
+	for resourceType, builtin := range s.builtin {
+		params[resourceType] = make(map[string]SearchParam, len(builtin))
+		for code, param := range builtin {
+			params[resourceType][code] = param
+		}
+	}
+	owners := map[string]string{}
+	for _, entry := range entries {
+		compiled, err := s.compileSearchParameter(entry.Resource)
+		if err != nil {
+			continue
+		}
+		for resourceType, param := range compiled {
+			if _, taken := params[resourceType][param.Code]; taken {
+				continue
+			}
+			params[resourceType][param.Code] = param
+			owners[resourceType+"/"+param.Code] = entry.Resource.GetID()
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.params, s.owners, s.customKey = params, owners, key
+}
+
+// compileSearchParameter returns the parameter resource defines for each
+// of its base types.
+func (s *Searcher) compileSearchParameter(resource dstu3.Resource) (map[string]SearchParam, error) {
+	definition, ok := resource.(*dstu3.SearchParameter)
+	if !ok {
+		return nil, fmt.Errorf("expected a SearchParameter, got %s", resource.GetResourceType())
+	}
+	if !isIdentifier(strings.ReplaceAll(definition.Code, "-", "_")) {
+		return nil, fmt.Errorf("invalid search parameter code %q", definition.Code)
+	}
+	paramType := ParamType(definition.Type)
+	switch paramType {
+	case ParamString, ParamToken, ParamDate, ParamReference, ParamQuantity, ParamNumber, ParamURI:
+	default:
+		return nil, fmt.Errorf("unsupported search parameter type %q", definition.Type)
+	}
+	if len(definition.Base) == 0 {
+		return nil, fmt.Errorf("search parameter %q has no base", definition.Code)
+	}
+	if strings.TrimSpace(definition.Expression) == "" {
+		return nil, fmt.Errorf("search parameter %q has no expression", definition.Code)
+	}
+	paths, err := compileExpression(definition.Expression)
+	if err != nil {
+		return nil, err
+	}
+
+	out := map[string]SearchParam{}
+	for _, base := range definition.Base {
+		if _, ok := s.builtin[base]; !ok {
+			return nil, fmt.Errorf("unsupported base type %s", base)
+		}
+		if len(paths[base]) == 0 {
+			return nil, fmt.Errorf("expression has no path for base %s", base)
+		}
+		out[base] = SearchParam{Code: definition.Code, Type: paramType, Paths: paths[base], Targets: definition.Target, Definition: definition.URL}
+	}
+	for resourceType := range paths {
+		if _, ok := out[resourceType]; !ok {
+			return nil, fmt.Errorf("expression path for %s is not in base", resourceType)
+		}
+	}
+	return out, nil
+}
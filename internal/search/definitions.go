@@ -0,0 +1,119 @@
+package search
+
+// commonParams apply to every resource type.
+var commonParams = []SearchParam{
+	{Code: "_id", Type: ParamToken, Paths: []string{"id"}},
+	{Code: "_lastUpdated", Type: ParamDate, Paths: []string{"meta.lastUpdated"}},
+	{Code: "_profile", Type: ParamURI, Paths: []string{"meta.profile"}},
+	{Code: "_tag", Type: ParamToken, Paths: []string{"meta.tag"}},
+}
+
+// resourceParams are the DSTU3 search parameters for each registered type,
+// limited to the elements our resource models carry.
+var resourceParams = map[string][]SearchParam{
+	"Patient": append([]SearchParam{
+		{Code: "identifier", Type: ParamToken, Paths: []string{"identifier"}},
+		{Code: "name", Type: ParamString, Paths: []string{"name"}},
+		{Code: "family", Type: ParamString, Paths: []string{"name.family"}},
+		{Code: "given", Type: ParamString, Paths: []string{"name.given"}},
+		{Code: "birthdate", Type: ParamDate, Paths: []string{"birthDate"}},
+		{Code: "gender", Type: ParamToken, Paths: []string{"gender"}},
+		{Code: "organization", Type: ParamReference, Paths: []string{"managingOrganization"}, Targets: []string{"Organization"}},
+		{Code: "general-practitioner", Type: ParamReference, Paths: []string{"generalPractitioner"}, Targets: []string{"Organization", "Practitioner"}},
+	}, append(telecomParams(), addressParams()...)...),
+	"Practitioner": append([]SearchParam{
+		{Code: "identifier", Type: ParamToken, Paths: []string{"identifier"}},
+		{Code: "name", Type: ParamString, Paths: []string{"name"}},
+		{Code: "family", Type: ParamString, Paths: []string{"name.family"}},
+		{Code: "given", Type: ParamString, Paths: []string{"name.given"}},
+	}, append(telecomParams(), addressParams()...)...),
+	"PractitionerRole": append([]SearchParam{
+		{Code: "practitioner", Type: ParamReference, Paths: []string{"practitioner"}, Targets: []string{"Practitioner"}},
+		{Code: "organization", Type: ParamReference, Paths: []string{"organization"}, Targets: []string{"Organization"}},
+		{Code: "location", Type: ParamReference, Paths: []string{"location"}, Targets: []string{"Location"}},
+		{Code: "service", Type: ParamReference, Paths: []string{"healthcareService"}, Targets: []string{"HealthcareService"}},
+	}, telecomParams()...),
+	"Organization": append([]SearchParam{
+		{Code: "identifier", Type: ParamToken, Paths: []string{"identifier"}},
+		{Code: "name", Type: ParamString, Paths: []string{"name"}},
+		{Code: "partof", Type: ParamReference, Paths: []string{"partOf"}, Targets: []string{"Organization"}},
+	}, addressParams()...),
+	"Observation": {
+		{Code: "code", Type: ParamToken, Paths: []string{"code"}},
+		{Code: "status", Type: ParamToken, Paths: []string{"status"}},
+		{Code: "date", Type: ParamDate, Paths: []string{"effectiveDateTime", "effectivePeriod"}},
+		{Code: "subject", Type: ParamReference, Paths: []string{"subject"}, Targets: []string{"Device", "Group", "Location", "Patient"}},
+		{Code: "patient", Type: ParamReference, Paths: []string{"subject"}, Targets: []string{"Patient"}},
+		{Code: "performer", Type: ParamReference, Paths: []string{"performer"}, Targets: []string{"Organization", "Patient", "Practitioner", "RelatedPerson"}},
+		{Code: "encounter", Type: ParamReference, Paths: []string{"encounter"}, Targets: []string{"Encounter"}},
+		{Code: "specimen", Type: ParamReference, Paths: []string{"specimen"}, Targets: []string{"Specimen"}},
+		{Code: "device", Type: ParamReference, Paths: []string{"device"}, Targets: []string{"Device", "DeviceMetric"}},
+	},
+	"Flag": {
+		{Code: "status", Type: ParamToken, Paths: []string{"status"}},
+		{Code: "subject", Type: ParamReference, Paths: []string{"subject"}, Targets: []string{"Group", "Location", "Medication", "Organization", "Patient", "PlanDefinition", "Practitioner", "Procedure"}},
+		{Code: "patient", Type: ParamReference, Paths: []string{"subject"}, Targets: []string{"Patient"}},
+		{Code: "author", Type: ParamReference, Paths: []string{"author"}, Targets: []string{"Device", "Organization", "Patient", "Practitioner"}},
+		{Code: "encounter", Type: ParamReference, Paths: []string{"encounter"}, Targets: []string{"Encounter"}},
+	},
+	"Consent": {
+		{Code: "status", Type: ParamToken, Paths: []string{"status"}},
+		{Code: "patient", Type: ParamReference, Paths: []string{"patient"}, Targets: []string{"Patient"}},
+		{Code: "actor", Type: ParamReference, Paths: []string{"actor.reference"}, Targets: []string{"CareTeam", "Device", "Group", "Organization", "Patient", "Practitioner", "RelatedPerson"}},
+		{Code: "organization", Type: ParamReference, Paths: []string{"organization"}, Targets: []string{"Organization"}},
+		{Code: "source", Type: ParamReference, Paths: []string{"sourceReference"}, Targets: []string{"Consent", "Contract", "DocumentReference", "QuestionnaireResponse"}},
+	},
+	"AdvanceDirective": {
+		{Code: "patient", Type: ParamReference, Paths: []string{"patient"}, Targets: []string{"Patient"}},
+		{Code: "author", Type: ParamReference, Paths: []string{"author"}, Targets: []string{"Organization", "Patient", "Practitioner", "RelatedPerson"}},
+	},
+	"Location": append([]SearchParam{
+		{Code: "name", Type: ParamString, Paths: []string{"name"}},
+		{Code: "status", Type: ParamToken, Paths: []string{"status"}},
+		{Code: "type", Type: ParamToken, Paths: []string{"type"}},
+		{Code: "organization", Type: ParamReference, Paths: []string{"managingOrganization"}, Targets: []string{"Organization"}},
+		{Code: "partof", Type: ParamReference, Paths: []string{"partOf"}, Targets: []string{"Location"}},
+	}, addressParams()...),
+	"Task": {
+		{Code: "status", Type: ParamToken, Paths: []string{"status"}},
+		{Code: "intent", Type: ParamToken, Paths: []string{"intent"}},
+		{Code: "priority", Type: ParamToken, Paths: []string{"priority"}},
+		{Code: "period", Type: ParamDate, Paths: []string{"executionPeriod"}},
+		{Code: "focus", Type: ParamReference, Paths: []string{"focus"}},
+		{Code: "for", Type: ParamReference, Paths: []string{"for"}},
+		{Code: "subject", Type: ParamReference, Paths: []string{"for"}},
+		{Code: "patient", Type: ParamReference, Paths: []string{"for"}, Targets: []string{"Patient"}},
+		{Code: "owner", Type: ParamReference, Paths: []string{"owner"}, Targets: []string{"Device", "Organization", "Patient", "Practitioner", "RelatedPerson"}},
+		{Code: "requester", Type: ParamReference, Paths: []string{"requester"}, Targets: []string{"Device", "Organization", "Patient", "Practitioner", "RelatedPerson"}},
+		{Code: "based-on", Type: ParamReference, Paths: []string{"basedOn"}},
+	},
+	"SearchParameter": {
+		{Code: "url", Type: ParamURI, Paths: []string{"url"}},
+		{Code: "name", Type: ParamString, Paths: []string{"name"}},
+		{Code: "status", Type: ParamToken, Paths: []string{"status"}},
+		{Code: "code", Type: ParamToken, Paths: []string{"code"}},
+		{Code: "base", Type: ParamToken, Paths: []string{"base"}},
+		{Code: "type", Type: ParamToken, Paths: []string{"type"}},
+		{Code: "target", Type: ParamToken, Paths: []string{"target"}},
+		{Code: "description", Type: ParamString, Paths: []string{"description"}},
+	},
+}
+
+func telecomParams() []SearchParam {
+	return []SearchParam{
+		{Code: "telecom", Type: ParamToken, Paths: []string{"telecom"}},
+		{Code: "phone", Type: ParamToken, Paths: []string{"telecom[system=phone]"}},
+		{Code: "email", Type: ParamToken, Paths: []string{"telecom[system=email]"}},
+	}
+}
+
+func addressParams() []SearchParam {
+	return []SearchParam{
+		{Code: "address", Type: ParamString, Paths: []string{"address"}},
+		{Code: "address-city", Type: ParamString, Paths: []string{"address.city"}},
+		{Code: "address-state", Type: ParamString, Paths: []string{"address.state"}},
+		{Code: "address-postalcode", Type: ParamString, Paths: []string{"address.postalCode"}},
+		{Code: "address-country", Type: ParamString, Paths: []string{"address.country"}},
+		{Code: "address-use", Type: ParamToken, Paths: []string{"address.use"}},
+	}
+}
@@ -0,0 +1,156 @@
+package search
+
+import (
+	"fmt"
+	"strings"
+)
+
+// compileExpression translates a SearchParameter expression into element
+// paths keyed by the resource type each alternative starts from. It
+// accepts the FHIRPath subset search parameters commonly use: element
+// names, extension('url'), where(element='value'), unions with "|", and a
+// final "as Type" or as(Type) that selects a choice element, as in
+// "Patient.extension('http://example.org/eye-colour').value as string".
+func compileExpression(expression string) (map[string][]string, error) {
+	out := map[string][]string{}
+	for _, alternative := range splitTopLevel(expression, "|") {
+		resourceType, path, err := compileExpressionPath(strings.TrimSpace(alternative))
+		if err != nil {
+			return nil, err
+		}
+		out[resourceType] = append(out[resourceType], path)
+	}
+	return out, nil
+}
+
+func compileExpressionPath(expression string) (string, string, error) {
+	expression = trimParens(expression)
+	castType := ""
+	if i := topLevelIndex(expression, " as "); i >= 0 {
+		castType = strings.TrimSpace(expression[i+len(" as "):])
+		expression = trimParens(strings.TrimSpace(expression[:i]))
+	}
+	steps := splitTopLevel(expression, ".")
+	if len(steps) < 2 || !isIdentifier(steps[0]) {
+		return "", "", fmt.Errorf("expression %q must be a resource type followed by a path", expression)
+	}
+
+	segments := []string{}
+	for i, step := range steps[1:] {
+		name, arg, call := parseCall(step)
+		switch {
+		case !call && isIdentifier(step):
+			segments = append(segments, step)
+		case call && name == "extension":
+			url, err := unquote(arg)
+			if err != nil {
+				return "", "", fmt.Errorf("expression %q: %w", expression, err)
+			}
+			segments = append(segments, "extension[url="+url+"]")
+		case call && name == "where":
+			key, value, ok := strings.Cut(arg, "=")
+			key = strings.TrimSpace(key)
+			if !ok || !isIdentifier(key) || len(segments) == 0 || strings.Contains(segments[len(segments)-1], "[") {
+				return "", "", fmt.Errorf("expression %q: unsupported where(%s)", expression, arg)
+			}
+			value, err := unquote(value)
+			if err != nil {
+				return "", "", fmt.Errorf("expression %q: %w", expression, err)
+			}
+			segments[len(segments)-1] += "[" + key + "=" + value + "]"
+		case call && (name == "as" || name == "ofType") && i == len(steps)-2 && castType == "":
+			castType = strings.TrimSpace(arg)
+		default:
+			return "", "", fmt.Errorf("expression %q: unsupported step %q", expression, step)
+		}
+	}
+	if castType != "" {
+		last := len(segments) - 1
+		if last < 0 || !isIdentifier(castType) || !isIdentifier(segments[last]) {
+			return "", "", fmt.Errorf("expression %q: unsupported cast to %q", expression, castType)
+		}
+		segments[last] += strings.ToUpper(castType[:1]) + castType[1:]
+	}
+	if len(segments) == 0 {
+		return "", "", fmt.Errorf("expression %q selects no element", expression)
+	}
+	return steps[0], strings.Join(segments, "."), nil
+}
+
+// topLevelIndex returns the index of the first sep outside quotes,
+// parentheses and brackets, or -1.
+func topLevelIndex(s, sep string) int {
+	depth := 0
+	var quote byte
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case depth == 0 && strings.HasPrefix(s[i:], sep):
+			return i
+		case c == '\'' || c == '"':
+			quote = c
+		case c == '(' || c == '[':
+			depth++
+		case c == ')' || c == ']':
+			depth--
+		}
+	}
+	return -1
+}
+
+func splitTopLevel(s, sep string) []string {
+	out := []string{}
+	for {
+		i := topLevelIndex(s, sep)
+		if i < 0 {
+			return append(out, s)
+		}
+		out = append(out, s[:i])
+		s = s[i+len(sep):]
+	}
+}
+
+// trimParens removes parentheses that enclose the whole of s.
+func trimParens(s string) string {
+	for strings.HasPrefix(s, "(") && topLevelIndex(s[1:], ")") == len(s)-2 {
+		s = strings.TrimSpace(s[1 : len(s)-1])
+	}
+	return s
+}
+
+// parseCall splits a step such as "where(use='home')" into its function
+// name and argument.
+func parseCall(step string) (string, string, bool) {
+	name, rest, ok := strings.Cut(step, "(")
+	if !ok || !strings.HasSuffix(rest, ")") || !isIdentifier(name) {
+		return "", "", false
+	}
+	return name, strings.TrimSpace(strings.TrimSuffix(rest, ")")), true
+}
+
+func unquote(s string) (string, error) {
+	s = strings.TrimSpace(s)
+	if len(s) < 2 || (s[0] != '\'' && s[0] != '"') || s[len(s)-1] != s[0] {
+		return "", fmt.Errorf("expected a quoted string, got %q", s)
+	}
+	return s[1 : len(s)-1], nil
+}
+
+func isIdentifier(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i, c := range s {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z':
+		case i > 0 && (c >= '0' && c <= '9' || c == '_'):
+		default:
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,462 @@
+package search
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"mini-fhir/internal/fhir/dstu3"
+)
+
+// The _filter expression grammar:
+//
+//	filter  = or
+//	or      = and ("or" and)*
+//	and     = unary ("and" unary)*
+//	unary   = "not" "(" filter ")" | "(" filter ")" | compare
+//	compare = path op value
+//	path    = name ("[" filter "]")? ("." path)?
+//
+// Names are search parameters; a dotted or bracketed step follows a
+// reference parameter to the resource it targets. "and" binds tighter
+// than "or".
+
+// FilterError reports a _filter syntax error at a 1-based position.
+type FilterError struct {
+	Pos int
+	Msg string
+}
+
+func (e *FilterError) Error() string {
+	return fmt.Sprintf("_filter error at position %d: %s", e.Pos, e.Msg)
+}
+
+var filterOperators = map[string]struct{}{
+	"eq": {}, "ne": {}, "co": {}, "sw": {}, "ew": {}, "gt": {}, "lt": {}, "ge": {}, "le": {},
+	"ap": {}, "sa": {}, "eb": {}, "pr": {}, "po": {}, "re": {},
+}
+
+type filterNode interface{}
+
+type filterLogic struct {
+	op          string
+	left, right filterNode
+}
+
+type filterNot struct {
+	inner filterNode
+}
+
+type filterCompare struct {
+	path  []filterStep
+	op    string
+	value string
+}
+
+// filterStep is one name in a path. target and where are set on
+// reference steps that the path continues through.
+type filterStep struct {
+	param  SearchParam
+	target string
+	where  filterNode
+}
+
+type filterToken struct {
+	text   string
+	pos    int
+	quoted bool
+}
+
+type filterParser struct {
+	searcher *Searcher
+	tokens   []filterToken
+	next     int
+	end      int
+}
+
+func (s *Searcher) parseFilter(resourceType, expression string) (filterNode, error) {
+	tokens, err := tokenizeFilter(expression)
+	if err != nil {
+		return nil, err
+	}
+	p := &filterParser{searcher: s, tokens: tokens, end: len(expression) + 1}
+	node, err := p.parseOr(resourceType)
+	if err != nil {
+		return nil, err
+	}
+	if tok, ok := p.peek(); ok {
+		return nil, &FilterError{Pos: tok.pos, Msg: fmt.Sprintf("unexpected %q", tok.text)}
+	}
+	return node, nil
+}
+
+func tokenizeFilter(expression string) ([]filterToken, error) {
+	tokens := []filterToken{}
+	for i := 0; i < len(expression); {
+		switch ch := expression[i]; {
+		case ch == ' ' || ch == '\t' || ch == '\n' || ch == '\r':
+			i++
+		case strings.IndexByte("()[]", ch) >= 0:
+			tokens = append(tokens, filterToken{text: string(ch), pos: i + 1})
+			i++
+		case ch == '"':
+			start := i
+			var text strings.Builder
+			i++
+			for ; i < len(expression) && expression[i] != '"'; i++ {
+				if expression[i] == '\\' && i+1 < len(expression) {
+					i++
+				}
+				text.WriteByte(expression[i])
+			}
+			if i >= len(expression) {
+				return nil, &FilterError{Pos: start + 1, Msg: "unterminated string"}
+			}
+			i++
+			tokens = append(tokens, filterToken{text: text.String(), pos: start + 1, quoted: true})
+		default:
+			start := i
+			for i < len(expression) && strings.IndexByte(" \t\n\r()[]\"", expression[i]) < 0 {
+				i++
+			}
+			tokens = append(tokens, filterToken{text: expression[start:i], pos: start + 1})
+		}
+	}
+	return tokens, nil
+}
+
+func (p *filterParser) peek() (filterToken, bool) {
+	if p.next >= len(p.tokens) {
+		return filterToken{}, false
+	}
+	return p.tokens[p.next], true
+}
+
+func (p *filterParser) peekKeyword(keyword string) bool {
+	tok, ok := p.peek()
+	return ok && !tok.quoted && strings.EqualFold(tok.text, keyword)
+}
+
+func (p *filterParser) take(what string) (filterToken, error) {
+	tok, ok := p.peek()
+	if !ok {
+		return filterToken{}, &FilterError{Pos: p.end, Msg: "expected " + what + " but the expression ended"}
+	}
+	p.next++
+	return tok, nil
+}
+
+func (p *filterParser) expect(text string) error {
+	tok, err := p.take(fmt.Sprintf("%q", text))
+	if err != nil {
+		return err
+	}
+	if tok.quoted || tok.text != text {
+		return &FilterError{Pos: tok.pos, Msg: fmt.Sprintf("expected %q, found %q", text, tok.text)}
+	}
+	return nil
+}
+
+func (p *filterParser) parseOr(resourceType string) (filterNode, error) {
+	left, err := p.parseAnd(resourceType)
+	if err != nil {
+		return nil, err
+	}
+	for p.peekKeyword("or") {
+		p.next++
+		right, err := p.parseAnd(resourceType)
+		if err != nil {
+			return nil, err
+		}
+		left = &filterLogic{op: "or", left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *filterParser) parseAnd(resourceType string) (filterNode, error) {
+	left, err := p.parseUnary(resourceType)
+	if err != nil {
+		return nil, err
+	}
+	for p.peekKeyword("and") {
+		p.next++
+		right, err := p.parseUnary(resourceType)
+		if err != nil {
+			return nil, err
+		}
+		left = &filterLogic{op: "and", left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *filterParser) parseUnary(resourceType string) (filterNode, error) {
+	negate := false
+	if p.peekKeyword("not") {
+		p.next++
+		negate = true
+		if tok, ok := p.peek(); !ok || tok.text != "(" {
+			return nil, p.expect("(")
+		}
+	}
+	if tok, ok := p.peek(); ok && !tok.quoted && tok.text == "(" {
+		p.next++
+		inner, err := p.parseOr(resourceType)
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		if negate {
+			return &filterNot{inner: inner}, nil
+		}
+		return inner, nil
+	}
+	return p.parseCompare(resourceType)
+}
+
+func (p *filterParser) parseCompare(resourceType string) (filterNode, error) {
+	path, err := p.parsePath(resourceType)
+	if err != nil {
+		return nil, err
+	}
+	tok, err := p.take("an operator")
+	if err != nil {
+		return nil, err
+	}
+	op := strings.ToLower(tok.text)
+	if _, ok := filterOperators[op]; !ok || tok.quoted {
+		return nil, &FilterError{Pos: tok.pos, Msg: fmt.Sprintf("unsupported operator %q", tok.text)}
+	}
+	value, err := p.take("a value")
+	if err != nil {
+		return nil, err
+	}
+	if !value.quoted && strings.IndexByte("()[]", value.text[0]) >= 0 {
+		return nil, &FilterError{Pos: value.pos, Msg: fmt.Sprintf("expected a value, found %q", value.text)}
+	}
+	last := path[len(path)-1].param
+	if op == "pr" && value.text != "true" && value.text != "false" {
+		return nil, &FilterError{Pos: value.pos, Msg: "pr expects true or false"}
+	}
+	if !filterOperatorFits(op, last.Type) {
+		return nil, &FilterError{Pos: tok.pos, Msg: fmt.Sprintf("operator %s does not apply to %s parameter %q", op, last.Type, last.Code)}
+	}
+	if op != "pr" {
+		if !validFilterValue(last.Type, value.text) {
+			return nil, &FilterError{Pos: value.pos, Msg: fmt.Sprintf("%q is not a valid %s value for %q", value.text, last.Type, last.Code)}
+		}
+	}
+	return &filterCompare{path: path, op: op, value: value.text}, nil
+}
+
+// filterOperatorFits reports whether op can be evaluated against a
+// parameter of the given type; eq, ne and pr apply to every type.
+func filterOperatorFits(op string, paramType ParamType) bool {
+	switch op {
+	case "co", "sw", "ew":
+		return paramType == ParamString || paramType == ParamToken || paramType == ParamURI || paramType == ParamReference
+	case "gt", "lt", "ge", "le", "sa", "eb", "ap":
+		return paramType == ParamDate || paramType == ParamNumber || paramType == ParamQuantity
+	case "po":
+		return paramType == ParamDate
+	case "re":
+		return paramType == ParamReference
+	default:
+		return true
+	}
+}
+
+// validFilterValue reports whether value can be read as the parameter's
+// type, so a bad value fails at parse time instead of matching nothing.
+func validFilterValue(paramType ParamType, value string) bool {
+	var err error
+	switch paramType {
+	case ParamDate:
+		_, _, err = dstu3.ParseDateRange(value)
+	case ParamNumber:
+		_, err = strconv.ParseFloat(value, 64)
+	case ParamQuantity:
+		number, _, _ := strings.Cut(value, "|")
+		_, err = strconv.ParseFloat(number, 64)
+	}
+	return err == nil
+}
+
+func (p *filterParser) parsePath(resourceType string) ([]filterStep, error) {
+	tok, err := p.take("a parameter name")
+	if err != nil {
+		return nil, err
+	}
+	if tok.quoted || strings.IndexByte("()[]", tok.text[0]) >= 0 {
+		return nil, &FilterError{Pos: tok.pos, Msg: fmt.Sprintf("expected a parameter name, found %q", tok.text)}
+	}
+	steps := []filterStep{}
+	names := strings.Split(tok.text, ".")
+	pos := tok.pos
+	for i, name := range names {
+		param, ok := p.searcher.paramTable()[resourceType][name]
+		if !ok {
+			return nil, &FilterError{Pos: pos, Msg: fmt.Sprintf("unknown search parameter %q for %s", name, resourceType)}
+		}
+		step := filterStep{param: param}
+		lastName := i == len(names)-1
+		bracket := lastName && p.peekKeyword("[")
+		if !lastName || bracket {
+			if param.Type != ParamReference {
+				return nil, &FilterError{Pos: pos, Msg: fmt.Sprintf("cannot follow %s parameter %q", param.Type, name)}
+			}
+			target, err := p.searcher.chainTarget(resourceType, param, "")
+			if err != nil {
+				return nil, &FilterError{Pos: pos, Msg: err.Error()}
+			}
+			step.target = target
+			resourceType = target
+		}
+		steps = append(steps, step)
+		pos += len(name) + 1
+		if !bracket {
+			continue
+		}
+
+		p.next++
+		where, err := p.parseOr(resourceType)
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect("]"); err != nil {
+			return nil, err
+		}
+		steps[len(steps)-1].where = where
+		rest, ok := p.peek()
+		if !ok || rest.quoted || !strings.HasPrefix(rest.text, ".") || len(rest.text) == 1 {
+			return nil, &FilterError{Pos: p.tokenPos(), Msg: "expected \".\" and a parameter name after \"]\""}
+		}
+		p.tokens[p.next].text = rest.text[1:]
+		p.tokens[p.next].pos++
+		more, err := p.parsePath(resourceType)
+		if err != nil {
+			return nil, err
+		}
+		return append(steps, more...), nil
+	}
+	return steps, nil
+}
+
+func (p *filterParser) tokenPos() int {
+	if tok, ok := p.peek(); ok {
+		return tok.pos
+	}
+	return p.end
+}
+
+func (s *Searcher) evalFilter(tree map[string]any, node filterNode) bool {
+	switch typed := node.(type) {
+	case *filterLogic:
+		if typed.op == "and" {
+			return s.evalFilter(tree, typed.left) && s.evalFilter(tree, typed.right)
+		}
+		return s.evalFilter(tree, typed.left) || s.evalFilter(tree, typed.right)
+	case *filterNot:
+		return !s.evalFilter(tree, typed.inner)
+	case *filterCompare:
+		if typed.op == "ne" {
+			return !s.evalPath(tree, typed.path, "eq", typed.value)
+		}
+		return s.evalPath(tree, typed.path, typed.op, typed.value)
+	default:
+		return false
+	}
+}
+
+func (s *Searcher) evalPath(tree map[string]any, path []filterStep, op, value string) bool {
+	step := path[0]
+	nodes := extract(tree, step.param.Paths)
+	if len(path) == 1 {
+		return compareFilter(step.param, nodes, op, value)
+	}
+	for _, node := range nodes {
+		key, ok := referenceKey(node)
+		if !ok {
+			continue
+		}
+		targetType, targetID, _ := strings.Cut(key, "/")
+		if targetType != step.target {
+			continue
+		}
+		entry, err := s.store.Get(targetType, targetID)
+		if err != nil {
+			continue
+		}
+		target := resourceTree(entry.Resource)
+		if step.where != nil && !s.evalFilter(target, step.where) {
+			continue
+		}
+		if s.evalPath(target, path[1:], op, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// compareFilter applies a _filter operator to the values of one parameter.
+func compareFilter(param SearchParam, nodes []any, op, value string) bool {
+	if op == "pr" {
+		return (len(nodes) > 0) == (value == "true")
+	}
+	for _, node := range nodes {
+		if compareFilterNode(param, node, op, value) {
+			return true
+		}
+	}
+	return false
+}
+
+func compareFilterNode(param SearchParam, node any, op, value string) bool {
+	switch op {
+	case "co", "sw", "ew":
+		texts := stringLeaves(node)
+		if param.Type == ParamToken {
+			texts = nil
+			for _, token := range tokenValues(node) {
+				texts = append(texts, token.code)
+			}
+		}
+		want := strings.ToLower(value)
+		for _, text := range texts {
+			text = strings.ToLower(text)
+			if (op == "co" && strings.Contains(text, want)) ||
+				(op == "sw" && strings.HasPrefix(text, want)) ||
+				(op == "ew" && strings.HasSuffix(text, want)) {
+				return true
+			}
+		}
+		return false
+	case "po":
+		start, end, err := dstu3.ParseDateRange(value)
+		if err != nil {
+			return false
+		}
+		target, ok := targetDateRange(node)
+		return ok && target.start.Before(end) && target.end.After(start)
+	case "re":
+		return matchReference(param, node, "", value)
+	}
+
+	switch param.Type {
+	case ParamString:
+		if op != "eq" {
+			return false
+		}
+		for _, text := range stringLeaves(node) {
+			if strings.EqualFold(text, value) {
+				return true
+			}
+		}
+		return false
+	case ParamDate, ParamNumber, ParamQuantity:
+		return matchValue(param, "", node, op+value)
+	default:
+		return op == "eq" && matchValue(param, "", node, value)
+	}
+}
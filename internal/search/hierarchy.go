@@ -0,0 +1,74 @@
+package search
+
+import (
+	"fmt"
+	"strings"
+)
+
+// matchHierarchy evaluates :below and :above on a reference that links
+// resources of one type into a tree. Both include the named resource:
+// partof:below=X matches X and its descendants, partof:above=X matches X
+// and its ancestors.
+func (s *Searcher) matchHierarchy(tree map[string]any, c criterion) bool {
+	resourceType := fmt.Sprint(tree["resourceType"])
+	self := resourceType + "/" + fmt.Sprint(tree["id"])
+	for _, value := range c.values {
+		valueType, valueID := splitReference(value)
+		if valueID == "" {
+			valueType, valueID = resourceType, value
+		}
+		want := valueType + "/" + valueID
+		if c.modifier == "above" {
+			if _, ok := s.ancestors(resourceType, c.param, want)[self]; ok {
+				return true
+			}
+			continue
+		}
+		if _, ok := s.ancestors(resourceType, c.param, self)[want]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// ancestors returns key and every resource reached by following param
+// upwards from it, stopping at cycles.
+func (s *Searcher) ancestors(resourceType string, param SearchParam, key string) map[string]struct{} {
+	seen := map[string]struct{}{}
+	pending := []string{key}
+	for len(pending) > 0 {
+		current := pending[0]
+		pending = pending[1:]
+		if _, ok := seen[current]; ok {
+			continue
+		}
+		seen[current] = struct{}{}
+		currentType, currentID, _ := strings.Cut(current, "/")
+		if currentType != resourceType {
+			continue
+		}
+		entry, err := s.store.Get(currentType, currentID)
+		if err != nil {
+			continue
+		}
+		for _, node := range extract(resourceTree(entry.Resource), param.Paths) {
+			if parent, ok := referenceKey(node); ok {
+				pending = append(pending, parent)
+			}
+		}
+	}
+	return seen
+}
+
+func referenceKey(node any) (string, bool) {
+	object, ok := node.(map[string]any)
+	if !ok {
+		return "", false
+	}
+	reference, _ := object["reference"].(string)
+	targetType, targetID := splitReference(reference)
+	if targetID == "" {
+		return "", false
+	}
+	return targetType + "/" + targetID, true
+}
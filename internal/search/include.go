@@ -0,0 +1,188 @@
+package search
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"mini-fhir/internal/store"
+)
+
+// DefaultIncludeDepth bounds how many rounds :iterate includes follow.
+const DefaultIncludeDepth = 2
+
+// includeSpec is a parsed _include or _revinclude value: the references
+// held by source resources in param, optionally only those to target.
+// A wildcard spec ("*") follows every reference.
+type includeSpec struct {
+	source   string
+	param    SearchParam
+	target   string
+	wildcard bool
+}
+
+func (s *Searcher) expandIncludes(entries []*store.ResourceEntry, query url.Values) ([]*store.ResourceEntry, error) {
+	specs := map[string][]includeSpec{}
+	for _, key := range []string{"_include", "_include:iterate", "_revinclude", "_revinclude:iterate"} {
+		parsed, err := s.parseIncludes(key, query[key])
+		if err != nil {
+			return nil, err
+		}
+		specs[key] = parsed
+	}
+	includes := append(specs["_include"], specs["_include:iterate"]...)
+	revIncludes := append(specs["_revinclude"], specs["_revinclude:iterate"]...)
+	if len(includes) == 0 && len(revIncludes) == 0 {
+		return nil, nil
+	}
+
+	seen := map[string]struct{}{}
+	for _, entry := range entries {
+		seen[entryKey(entry)] = struct{}{}
+	}
+	result := []*store.ResourceEntry{}
+	current := entries
+	for depth := 1; depth <= s.includeDepth && len(current) > 0; depth++ {
+		added := s.included(current, includes, seen, &result)
+		reverse, err := s.revIncluded(current, revIncludes, seen, &result)
+		if err != nil {
+			return nil, err
+		}
+		current = append(added, reverse...)
+		includes, revIncludes = specs["_include:iterate"], specs["_revinclude:iterate"]
+	}
+	return result, nil
+}
+
+func (s *Searcher) parseIncludes(key string, values []string) ([]includeSpec, error) {
+	out := []includeSpec{}
+	for _, value := range values {
+		if value == "*" && !strings.HasPrefix(key, "_revinclude") {
+			out = append(out, includeSpec{wildcard: true})
+			continue
+		}
+		parts := strings.Split(value, ":")
+		if len(parts) < 2 || len(parts) > 3 {
+			return nil, fmt.Errorf("invalid %s %q: expected Source:param[:Target]", key, value)
+		}
+		params, ok := s.paramTable()[parts[0]]
+		if !ok {
+			return nil, fmt.Errorf("invalid %s %q: unsupported resource type %s", key, value, parts[0])
+		}
+		param, ok := params[parts[1]]
+		if !ok || param.Type != ParamReference {
+			return nil, fmt.Errorf("invalid %s %q: %s has no reference parameter %q", key, value, parts[0], parts[1])
+		}
+		spec := includeSpec{source: parts[0], param: param}
+		if len(parts) == 3 {
+			if !allowsTarget(param, parts[2]) {
+				return nil, fmt.Errorf("invalid %s %q: %s cannot refer to %s", key, value, param.Code, parts[2])
+			}
+			spec.target = parts[2]
+		}
+		out = append(out, spec)
+	}
+	return out, nil
+}
+
+// included appends the resources entries refer to through specs and
+// returns the ones it added.
+func (s *Searcher) included(entries []*store.ResourceEntry, specs []includeSpec, seen map[string]struct{}, result *[]*store.ResourceEntry) []*store.ResourceEntry {
+	added := []*store.ResourceEntry{}
+	for _, entry := range entries {
+		for _, spec := range specs {
+			for _, reference := range spec.references(entry) {
+				targetType, targetID := splitReference(reference)
+				key := targetType + "/" + targetID
+				if _, ok := seen[key]; ok {
+					continue
+				}
+				target, err := s.store.Get(targetType, targetID)
+				if err != nil {
+					continue
+				}
+				seen[key] = struct{}{}
+				*result = append(*result, target)
+				added = append(added, target)
+			}
+		}
+	}
+	return added
+}
+
+// revIncluded appends the resources that refer to any of entries through
+// specs and returns the ones it added.
+func (s *Searcher) revIncluded(entries []*store.ResourceEntry, specs []includeSpec, seen map[string]struct{}, result *[]*store.ResourceEntry) ([]*store.ResourceEntry, error) {
+	if len(entries) == 0 || len(specs) == 0 {
+		return nil, nil
+	}
+	targets := map[string]struct{}{}
+	for _, entry := range entries {
+		targets[entryKey(entry)] = struct{}{}
+	}
+	added := []*store.ResourceEntry{}
+	for _, spec := range specs {
+		candidates, err := s.store.List(spec.source)
+		if err != nil {
+			return nil, err
+		}
+		for _, candidate := range candidates {
+			key := entryKey(candidate)
+			if _, ok := seen[key]; ok {
+				continue
+			}
+			if !refersTo(spec.references(candidate), targets) {
+				continue
+			}
+			seen[key] = struct{}{}
+			*result = append(*result, candidate)
+			added = append(added, candidate)
+		}
+	}
+	return added, nil
+}
+
+// references returns the references entry holds through the spec's
+// parameter, or nothing when entry is not of the spec's source type.
+func (spec includeSpec) references(entry *store.ResourceEntry) []string {
+	out := []string{}
+	if spec.wildcard {
+		for _, ref := range entry.Resource.References() {
+			out = append(out, ref.Reference)
+		}
+		return out
+	}
+	if entry.Resource.GetResourceType() != spec.source {
+		return nil
+	}
+	for _, node := range extract(resourceTree(entry.Resource), spec.param.Paths) {
+		object, ok := node.(map[string]any)
+		if !ok {
+			continue
+		}
+		reference, _ := object["reference"].(string)
+		targetType, targetID := splitReference(reference)
+		if targetID == "" || !allowsTarget(spec.param, targetType) {
+			continue
+		}
+		if spec.target != "" && targetType != spec.target {
+			continue
+		}
+		out = append(out, reference)
+	}
+	return out
+}
+
+func refersTo(references []string, targets map[string]struct{}) bool {
+	for _, reference := range references {
+		targetType, targetID := splitReference(reference)
+		if _, ok := targets[targetType+"/"+targetID]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+func entryKey(entry *store.ResourceEntry) string {
+	return entry.Resource.GetResourceType() + "/" + entry.Resource.GetID()
+}
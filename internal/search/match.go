@@ -0,0 +1,395 @@
+package search
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"mini-fhir/internal/fhir/dstu3"
+)
+
+var (
+	minTime = time.Date(1, 1, 1, 0, 0, 0, 0, time.UTC)
+	maxTime = time.Date(9999, 12, 31, 23, 59, 59, 0, time.UTC)
+
+	comparisonPrefixes = map[string]struct{}{
+		"eq": {}, "ne": {}, "gt": {}, "lt": {}, "ge": {}, "le": {}, "sa": {}, "eb": {}, "ap": {},
+	}
+)
+
+func matchValue(param SearchParam, modifier string, node any, value string) bool {
+	switch param.Type {
+	case ParamString:
+		return matchString(node, modifier, value)
+	case ParamToken:
+		if modifier == "text" {
+			return matchTokenText(node, value)
+		}
+		return matchToken(node, value)
+	case ParamDate:
+		return matchDate(node, value)
+	case ParamReference:
+		return matchReference(param, node, modifier, value)
+	case ParamQuantity:
+		return matchQuantity(node, value)
+	case ParamNumber:
+		return matchNumber(node, value)
+	case ParamURI:
+		text, ok := node.(string)
+		switch {
+		case !ok:
+			return false
+		case modifier == "below":
+			return strings.HasPrefix(text, value)
+		case modifier == "above":
+			return strings.HasPrefix(value, text)
+		default:
+			return text == value
+		}
+	default:
+		return false
+	}
+}
+
+// matchString is case-insensitive "starts with" against any string part of
+// the element, so a HumanName matches on family, given, text and so on.
+// :exact compares whole strings case-sensitively and :contains matches
+// anywhere in the string.
+func matchString(node any, modifier, value string) bool {
+	want := strings.ToLower(value)
+	for _, text := range stringLeaves(node) {
+		switch modifier {
+		case "exact":
+			if text == value {
+				return true
+			}
+		case "contains":
+			if strings.Contains(strings.ToLower(text), want) {
+				return true
+			}
+		default:
+			if strings.HasPrefix(strings.ToLower(text), want) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func stringLeaves(node any) []string {
+	switch typed := node.(type) {
+	case string:
+		return []string{typed}
+	case []any:
+		out := []string{}
+		for _, item := range typed {
+			out = append(out, stringLeaves(item)...)
+		}
+		return out
+	case map[string]any:
+		keys := make([]string, 0, len(typed))
+		for key := range typed {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		out := []string{}
+		for _, key := range keys {
+			if key == "use" || key == "period" || key == "extension" {
+				continue
+			}
+			out = append(out, stringLeaves(typed[key])...)
+		}
+		return out
+	default:
+		return nil
+	}
+}
+
+type tokenValue struct {
+	system string
+	code   string
+}
+
+func matchToken(node any, value string) bool {
+	system, code, hasSystem := strings.Cut(value, "|")
+	if !hasSystem {
+		code, system = system, ""
+	}
+	for _, token := range tokenValues(node) {
+		if hasSystem {
+			if system == "" && token.system != "" {
+				continue
+			}
+			if system != "" && token.system != system {
+				continue
+			}
+		}
+		if code == "" || token.code == code {
+			return true
+		}
+	}
+	return false
+}
+
+// tokenValues flattens codes, Codings, CodeableConcepts, Identifiers and
+// ContactPoints into system/code pairs.
+func tokenValues(node any) []tokenValue {
+	switch typed := node.(type) {
+	case string:
+		return []tokenValue{{code: typed}}
+	case bool:
+		return []tokenValue{{code: strconv.FormatBool(typed)}}
+	case map[string]any:
+		if codings, ok := typed["coding"].([]any); ok {
+			out := []tokenValue{}
+			for _, coding := range codings {
+				out = append(out, tokenValues(coding)...)
+			}
+			return out
+		}
+		system, _ := typed["system"].(string)
+		if code, ok := typed["code"].(string); ok {
+			return []tokenValue{{system: system, code: code}}
+		}
+		if code, ok := typed["value"].(string); ok {
+			return []tokenValue{{system: system, code: code}}
+		}
+	}
+	return nil
+}
+
+// matchTokenText matches the display text of a CodeableConcept, Coding
+// or Identifier type rather than its codes.
+func matchTokenText(node any, value string) bool {
+	object, ok := node.(map[string]any)
+	if !ok {
+		return false
+	}
+	texts := []any{object["text"], object["display"]}
+	if kind, ok := object["type"].(map[string]any); ok {
+		texts = append(texts, kind["text"])
+	}
+	if codings, ok := object["coding"].([]any); ok {
+		for _, coding := range codings {
+			if coding, ok := coding.(map[string]any); ok {
+				texts = append(texts, coding["display"])
+			}
+		}
+	}
+	want := strings.ToLower(value)
+	for _, text := range texts {
+		if text, ok := text.(string); ok && strings.HasPrefix(strings.ToLower(text), want) {
+			return true
+		}
+	}
+	return false
+}
+
+type dateRange struct {
+	start time.Time
+	end   time.Time
+}
+
+func splitPrefix(value string) (string, string) {
+	if len(value) > 2 {
+		if _, ok := comparisonPrefixes[value[:2]]; ok {
+			return value[:2], value[2:]
+		}
+	}
+	return "eq", value
+}
+
+func matchDate(node any, value string) bool {
+	prefix, raw := splitPrefix(value)
+	start, end, err := dstu3.ParseDateRange(raw)
+	if err != nil {
+		return false
+	}
+	target, ok := targetDateRange(node)
+	if !ok {
+		return false
+	}
+	return compareRanges(prefix, dateRange{start: start, end: end}, target)
+}
+
+func targetDateRange(node any) (dateRange, bool) {
+	switch typed := node.(type) {
+	case string:
+		start, end, err := dstu3.ParseDateRange(typed)
+		if err != nil {
+			return dateRange{}, false
+		}
+		return dateRange{start: start, end: end}, true
+	case map[string]any:
+		out := dateRange{start: minTime, end: maxTime}
+		startText, hasStart := typed["start"].(string)
+		endText, hasEnd := typed["end"].(string)
+		if !hasStart && !hasEnd {
+			return dateRange{}, false
+		}
+		if hasStart {
+			start, _, err := dstu3.ParseDateRange(startText)
+			if err != nil {
+				return dateRange{}, false
+			}
+			out.start = start
+		}
+		if hasEnd {
+			_, end, err := dstu3.ParseDateRange(endText)
+			if err != nil {
+				return dateRange{}, false
+			}
+			out.end = end
+		}
+		return out, true
+	default:
+		return dateRange{}, false
+	}
+}
+
+func compareRanges(prefix string, param, target dateRange) bool {
+	contained := !target.start.Before(param.start) && !target.end.After(param.end)
+	switch prefix {
+	case "eq":
+		return contained
+	case "ne":
+		return !contained
+	case "gt":
+		return target.end.After(param.end)
+	case "lt":
+		return target.start.Before(param.start)
+	case "ge":
+		return contained || target.end.After(param.end)
+	case "le":
+		return contained || target.start.Before(param.start)
+	case "sa":
+		return !target.start.Before(param.end)
+	case "eb":
+		return !target.end.After(param.start)
+	case "ap":
+		gap := time.Duration(math.Abs(float64(time.Since(param.start))) * 0.1)
+		return target.start.Before(param.end.Add(gap)) && target.end.After(param.start.Add(-gap))
+	default:
+		return false
+	}
+}
+
+func matchReference(param SearchParam, node any, modifier, value string) bool {
+	object, ok := node.(map[string]any)
+	if !ok {
+		return false
+	}
+	reference, _ := object["reference"].(string)
+	targetType, targetID := splitReference(reference)
+	if targetID == "" || !allowsTarget(param, targetType) {
+		return false
+	}
+	wantType, wantID := splitReference(value)
+	if wantID == "" {
+		wantID = value
+	}
+	if modifier != "" {
+		if wantType != "" && wantType != modifier {
+			return false
+		}
+		wantType = modifier
+	}
+	if wantType != "" && wantType != targetType {
+		return false
+	}
+	return wantID == targetID
+}
+
+// allowsTarget reports whether a reference to resourceType can satisfy
+// param, so "patient" only matches subjects that are Patients.
+func allowsTarget(param SearchParam, resourceType string) bool {
+	if len(param.Targets) == 0 {
+		return true
+	}
+	for _, target := range param.Targets {
+		if target == resourceType {
+			return true
+		}
+	}
+	return false
+}
+
+// splitReference returns the type and id of a relative or absolute
+// reference, ignoring any _history suffix.
+func splitReference(reference string) (string, string) {
+	if before, _, ok := strings.Cut(reference, "/_history/"); ok {
+		reference = before
+	}
+	parts := strings.Split(reference, "/")
+	if len(parts) < 2 {
+		return "", ""
+	}
+	return parts[len(parts)-2], parts[len(parts)-1]
+}
+
+func matchQuantity(node any, value string) bool {
+	parts := strings.SplitN(value, "|", 3)
+	object, ok := node.(map[string]any)
+	if !ok {
+		return false
+	}
+	if len(parts) == 3 {
+		system, _ := object["system"].(string)
+		code, _ := object["code"].(string)
+		unit, _ := object["unit"].(string)
+		switch {
+		case parts[1] == "":
+			if parts[2] != "" && code != parts[2] && unit != parts[2] {
+				return false
+			}
+		case system != parts[1] || (parts[2] != "" && code != parts[2]):
+			return false
+		}
+	}
+	return matchNumber(object["value"], parts[0])
+}
+
+func matchNumber(node any, value string) bool {
+	target, ok := node.(float64)
+	if !ok {
+		return false
+	}
+	prefix, raw := splitPrefix(value)
+	want, err := strconv.ParseFloat(raw, 64)
+	if err != nil {
+		return false
+	}
+	half := precisionHalf(raw)
+	switch prefix {
+	case "eq":
+		return target >= want-half && target < want+half
+	case "ne":
+		return target < want-half || target >= want+half
+	case "gt", "sa":
+		return target > want
+	case "lt", "eb":
+		return target < want
+	case "ge":
+		return target >= want
+	case "le":
+		return target <= want
+	case "ap":
+		return math.Abs(target-want) <= math.Abs(want)*0.1
+	default:
+		return false
+	}
+}
+
+// precisionHalf is half of the last significant decimal place of value,
+// so "5.4" matches [5.35, 5.45).
+func precisionHalf(value string) float64 {
+	mantissa, exponentText, _ := strings.Cut(strings.ToLower(value), "e")
+	exponent, _ := strconv.Atoi(exponentText)
+	decimals := 0
+	if _, fraction, ok := strings.Cut(mantissa, "."); ok {
+		decimals = len(fraction)
+	}
+	return 0.5 * math.Pow(10, float64(exponent-decimals))
+}
@@ -0,0 +1,186 @@
+package search
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"sync"
+
+	"mini-fhir/internal/store"
+)
+
+const (
+	DefaultPageSize    = 50
+	DefaultMaxPageSize = 500
+
+	// PagesParam and PagesOffsetParam address a page of an earlier search.
+	PagesParam       = "_getpages"
+	PagesOffsetParam = "_getpagesoffset"
+
+	maxPageSnapshots = 100
+)
+
+var ErrPageNotFound = errors.New("search result page not found or expired")
+
+// pageSnapshot freezes the matches of a paged search so later pages do not
+// shift as the store changes. The resources each page includes are
+// computed when the page is first served and kept for repeat requests.
+type pageSnapshot struct {
+	token        string
+	resourceType string
+	query        url.Values
+	entries      []*store.ResourceEntry
+	pageSize     int
+
+	mu       sync.Mutex
+	includes map[int][]*store.ResourceEntry
+}
+
+type pageCache struct {
+	mu        sync.Mutex
+	snapshots map[string]*pageSnapshot
+	order     []string
+}
+
+func newPageCache() *pageCache {
+	return &pageCache{snapshots: map[string]*pageSnapshot{}}
+}
+
+func (p *pageCache) add(snapshot *pageSnapshot) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.snapshots[snapshot.token] = snapshot
+	p.order = append(p.order, snapshot.token)
+	for len(p.order) > maxPageSnapshots {
+		delete(p.snapshots, p.order[0])
+		p.order = p.order[1:]
+	}
+}
+
+func (p *pageCache) get(token string) (*pageSnapshot, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	snapshot, ok := p.snapshots[token]
+	return snapshot, ok
+}
+
+// page returns one page of entries, snapshotting them when the results
+// span more than one page.
+func (s *Searcher) page(resourceType string, entries []*store.ResourceEntry, query url.Values) (*SearchResult, error) {
+	size, err := s.pageSize(query.Get("_count"), s.defaultPageSize)
+	if err != nil {
+		return nil, err
+	}
+	if query.Get("_summary") == "count" {
+		size = 0
+	}
+	result := &SearchResult{Count: len(entries), PageSize: size, IncludeDepth: s.includeDepth}
+	if size == 0 || len(entries) <= size {
+		result.Entries = entries[:min(size, len(entries))]
+		if result.Included, err = s.expandIncludes(result.Entries, query); err != nil {
+			return nil, err
+		}
+		return result, nil
+	}
+
+	snapshot := &pageSnapshot{
+		token:        newPageToken(),
+		resourceType: resourceType,
+		query:        query,
+		entries:      entries,
+		pageSize:     size,
+		includes:     map[int][]*store.ResourceEntry{},
+	}
+	result, err = s.snapshotPage(snapshot, 0, size)
+	if err != nil {
+		return nil, err
+	}
+	s.pages.add(snapshot)
+	return result, nil
+}
+
+// Page serves a page of an earlier search from its snapshot.
+func (s *Searcher) Page(resourceType string, query url.Values) (*SearchResult, error) {
+	snapshot, ok := s.pages.get(query.Get(PagesParam))
+	if !ok || snapshot.resourceType != resourceType {
+		return nil, ErrPageNotFound
+	}
+	offset := 0
+	if raw := query.Get(PagesOffsetParam); raw != "" {
+		parsed, err := strconv.Atoi(raw)
+		if err != nil || parsed < 0 {
+			return nil, fmt.Errorf("invalid %s value", PagesOffsetParam)
+		}
+		offset = parsed
+	}
+	size, err := s.pageSize(query.Get("_count"), snapshot.pageSize)
+	if err != nil {
+		return nil, err
+	}
+	return s.snapshotPage(snapshot, offset, size)
+}
+
+// snapshotPage serves one page of snapshot. Includes for pages of the
+// snapshot's own size are cached; other sizes are computed each time.
+func (s *Searcher) snapshotPage(snapshot *pageSnapshot, offset, size int) (*SearchResult, error) {
+	result := &SearchResult{
+		Entries:      pageEntries(snapshot.entries, offset, size),
+		Count:        len(snapshot.entries),
+		IncludeDepth: s.includeDepth,
+		Token:        snapshot.token,
+		Offset:       offset,
+		PageSize:     size,
+	}
+	cached := size == snapshot.pageSize
+	if cached {
+		snapshot.mu.Lock()
+		defer snapshot.mu.Unlock()
+		if included, ok := snapshot.includes[offset]; ok {
+			result.Included = included
+			return result, nil
+		}
+	}
+	included, err := s.expandIncludes(result.Entries, snapshot.query)
+	if err != nil {
+		return nil, err
+	}
+	if cached {
+		snapshot.includes[offset] = included
+	}
+	result.Included = included
+	return result, nil
+}
+
+// pageSize parses _count, falling back to fallback and capping at the
+// configured maximum.
+func (s *Searcher) pageSize(count string, fallback int) (int, error) {
+	size := fallback
+	if count != "" {
+		parsed, err := parseCount(count)
+		if err != nil {
+			return 0, err
+		}
+		size = parsed
+	}
+	return min(size, s.maxPageSize), nil
+}
+
+func pageEntries(entries []*store.ResourceEntry, offset, size int) []*store.ResourceEntry {
+	if offset >= len(entries) {
+		return nil
+	}
+	return entries[offset:min(offset+size, len(entries))]
+}
+
+func newPageToken() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(fmt.Sprintf("page token: %v", err))
+	}
+	return hex.EncodeToString(b[:])
+}
@@ -0,0 +1,508 @@
+package search
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+
+	"mini-fhir/internal/fhir/dstu3"
+	"mini-fhir/internal/store"
+)
+
+type ParamType string
+
+const (
+	ParamString    ParamType = "string"
+	ParamToken     ParamType = "token"
+	ParamDate      ParamType = "date"
+	ParamReference ParamType = "reference"
+	ParamQuantity  ParamType = "quantity"
+	ParamNumber    ParamType = "number"
+	ParamURI       ParamType = "uri"
+)
+
+// SearchParam describes a search parameter and the element paths it
+// indexes. Paths are dot-separated JSON element names relative to the
+// resource; a segment may filter repeating elements, as in
+// "telecom[system=phone]". Definition is the canonical URL of a
+// parameter registered through a SearchParameter resource.
+type SearchParam struct {
+	Code       string
+	Type       ParamType
+	Paths      []string
+	Targets    []string
+	Definition string
+}
+
+// resultParams control paging and shaping rather than filtering.
+var resultParams = map[string]struct{}{
+	"_sort":               {},
+	"_count":              {},
+	"_include":            {},
+	"_include:iterate":    {},
+	"_revinclude":         {},
+	"_revinclude:iterate": {},
+	"_summary":            {},
+	"_elements":           {},
+	PagesParam:            {},
+	PagesOffsetParam:      {},
+	"_format":             {},
+	"_pretty":             {},
+}
+
+// criterion is one parsed filter parameter. A chained criterion resolves
+// references to chainType and applies chain to the referenced resource;
+// a _has criterion matches resources referred to by others.
+type criterion struct {
+	param     SearchParam
+	modifier  string
+	values    []string
+	chainType string
+	chain     *criterion
+	has       *hasCriterion
+	filter    filterNode
+}
+
+// hasCriterion is a parsed "_has:source:param:..." parameter. targets
+// holds the "Type/id" keys referred to by matching sources once computed.
+type hasCriterion struct {
+	source  string
+	param   SearchParam
+	inner   criterion
+	targets map[string]struct{}
+}
+
+func (s *Searcher) Params(resourceType string) []SearchParam {
+	s.syncCustomParams()
+	params := s.paramTable()[resourceType]
+	out := make([]SearchParam, 0, len(params))
+	for _, param := range params {
+		out = append(out, param)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Code < out[j].Code })
+	return out
+}
+
+func buildParams(registry *dstu3.Registry) map[string]map[string]SearchParam {
+	out := map[string]map[string]SearchParam{}
+	for _, resourceType := range registry.ResourceTypes() {
+		params := map[string]SearchParam{}
+		for _, param := range commonParams {
+			params[param.Code] = param
+		}
+		for _, param := range resourceParams[resourceType] {
+			params[param.Code] = param
+		}
+		out[resourceType] = params
+	}
+	return out
+}
+
+// IgnoreUnknown returns query without the parameters resourceType does
+// not define, which is FHIR's default lenient handling. For a system
+// search, resourceType is empty and a parameter is kept when any searched
+// type defines it. Modifiers, chains, _has and _filter are still checked
+// by the search itself.
+func (s *Searcher) IgnoreUnknown(resourceType string, query url.Values) url.Values {
+	s.syncCustomParams()
+	resourceTypes := []string{resourceType}
+	if resourceType == "" {
+		var err error
+		if resourceTypes, err = s.systemTypes(query["_type"]); err != nil {
+			return query
+		}
+	}
+	out := url.Values{}
+	for key, values := range query {
+		if s.knownParam(resourceTypes, key) {
+			out[key] = values
+		}
+	}
+	return out
+}
+
+func (s *Searcher) knownParam(resourceTypes []string, key string) bool {
+	if _, ok := resultParams[key]; ok || key == "_type" || key == "_filter" || strings.HasPrefix(key, "_has:") {
+		return true
+	}
+	head, _, _ := strings.Cut(key, ".")
+	code, _, _ := strings.Cut(head, ":")
+	for _, resourceType := range resourceTypes {
+		if _, ok := s.paramTable()[resourceType][code]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Searcher) parseCriteria(resourceType string, query url.Values) ([]criterion, error) {
+	if _, ok := s.paramTable()[resourceType]; !ok {
+		return nil, fmt.Errorf("unsupported resource type: %s", resourceType)
+	}
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	criteria := []criterion{}
+	for _, key := range keys {
+		if _, ok := resultParams[key]; ok {
+			continue
+		}
+		if key == "_type" {
+			return nil, fmt.Errorf("_type applies only to system search")
+		}
+		for _, value := range query[key] {
+			c, err := s.parseCriterion(resourceType, key, value)
+			if err != nil {
+				return nil, err
+			}
+			criteria = append(criteria, c)
+		}
+	}
+	return criteria, nil
+}
+
+// parseCriterion parses a parameter name such as "subject:Patient.name",
+// following each chained reference to the resource type it targets.
+func (s *Searcher) parseCriterion(resourceType, key, value string) (criterion, error) {
+	params, ok := s.paramTable()[resourceType]
+	if !ok {
+		return criterion{}, fmt.Errorf("unsupported resource type: %s", resourceType)
+	}
+	if strings.HasPrefix(key, "_has:") {
+		return s.parseHas(resourceType, key, value)
+	}
+	if key == "_filter" {
+		filter, err := s.parseFilter(resourceType, value)
+		if err != nil {
+			return criterion{}, err
+		}
+		return criterion{filter: filter}, nil
+	}
+	head, rest, chained := strings.Cut(key, ".")
+	code, modifier, _ := strings.Cut(head, ":")
+	param, ok := params[code]
+	if !ok {
+		return criterion{}, fmt.Errorf("unknown search parameter %q for %s", code, resourceType)
+	}
+	if err := s.checkModifier(resourceType, param, modifier); err != nil {
+		return criterion{}, err
+	}
+	if !chained {
+		if modifier == "missing" && value != "true" && value != "false" {
+			return criterion{}, fmt.Errorf("%s:missing must be true or false", param.Code)
+		}
+		return criterion{param: param, modifier: modifier, values: splitValues(value)}, nil
+	}
+
+	if param.Type != ParamReference {
+		return criterion{}, fmt.Errorf("cannot chain from %s parameter %q", param.Type, param.Code)
+	}
+	target, err := s.chainTarget(resourceType, param, modifier)
+	if err != nil {
+		return criterion{}, err
+	}
+	next, err := s.parseCriterion(target, rest, value)
+	if err != nil {
+		return criterion{}, err
+	}
+	return criterion{param: param, modifier: modifier, chainType: target, chain: &next}, nil
+}
+
+// parseHas parses "_has:Observation:patient:code", which matches
+// resources referred to through Observation's patient parameter by an
+// Observation that matches code. The trailing part may itself be a _has.
+func (s *Searcher) parseHas(resourceType, key, value string) (criterion, error) {
+	parts := strings.SplitN(key, ":", 4)
+	if len(parts) != 4 || parts[1] == "" || parts[2] == "" || parts[3] == "" {
+		return criterion{}, fmt.Errorf("invalid %q: expected _has:Type:reference:parameter", key)
+	}
+	source, code, rest := parts[1], parts[2], parts[3]
+	params, ok := s.paramTable()[source]
+	if !ok {
+		return criterion{}, fmt.Errorf("invalid %q: unsupported resource type %s", key, source)
+	}
+	param, ok := params[code]
+	if !ok || param.Type != ParamReference {
+		return criterion{}, fmt.Errorf("invalid %q: %s has no reference parameter %q", key, source, code)
+	}
+	if !allowsTarget(param, resourceType) {
+		return criterion{}, fmt.Errorf("invalid %q: %s parameter %q cannot refer to %s", key, source, code, resourceType)
+	}
+	inner, err := s.parseCriterion(source, rest, value)
+	if err != nil {
+		return criterion{}, err
+	}
+	return criterion{param: param, has: &hasCriterion{source: source, param: param, inner: inner}}, nil
+}
+
+func (s *Searcher) chainTarget(resourceType string, param SearchParam, modifier string) (string, error) {
+	if modifier != "" {
+		if !allowsTarget(param, modifier) {
+			return "", fmt.Errorf("%s parameter %q cannot refer to %s", resourceType, param.Code, modifier)
+		}
+		return modifier, nil
+	}
+	if len(param.Targets) != 1 {
+		return "", fmt.Errorf("chained parameter %q on %s is ambiguous; specify the target type as %s:[type]", param.Code, resourceType, param.Code)
+	}
+	target := param.Targets[0]
+	if _, ok := s.registry.Info(target); !ok {
+		return "", fmt.Errorf("unsupported resource type: %s", target)
+	}
+	return target, nil
+}
+
+// supportedModifiers lists the modifiers each parameter type accepts
+// besides :missing. Reference parameters also accept a target type.
+var supportedModifiers = map[ParamType][]string{
+	ParamString: {"exact", "contains"},
+	ParamToken:  {"not", "text"},
+	ParamURI:    {"above", "below"},
+}
+
+func (s *Searcher) checkModifier(resourceType string, param SearchParam, modifier string) error {
+	if modifier == "" || modifier == "missing" {
+		return nil
+	}
+	if param.Type == ParamReference {
+		if modifier == "above" || modifier == "below" {
+			if hierarchical(resourceType, param) {
+				return nil
+			}
+			return fmt.Errorf("modifier %q requires a hierarchical reference; %s parameter %q does not refer to %s", modifier, resourceType, param.Code, resourceType)
+		}
+		if _, ok := s.registry.Info(modifier); ok {
+			return nil
+		}
+	}
+	for _, supported := range supportedModifiers[param.Type] {
+		if modifier == supported {
+			return nil
+		}
+	}
+	return fmt.Errorf("modifier %q is not supported for %s parameter %q", modifier, param.Type, param.Code)
+}
+
+// hierarchical reports whether param links resources of resourceType to
+// others of the same type, as Location.partOf does.
+func hierarchical(resourceType string, param SearchParam) bool {
+	return len(param.Targets) > 0 && allowsTarget(param, resourceType)
+}
+
+func (s *Searcher) filter(entries []*store.ResourceEntry, criteria []criterion) []*store.ResourceEntry {
+	if len(criteria) == 0 {
+		return entries
+	}
+	filtered := make([]*store.ResourceEntry, 0, len(entries))
+	for _, entry := range entries {
+		tree := resourceTree(entry.Resource)
+		matched := true
+		for _, c := range criteria {
+			if !s.matchCriterion(tree, c) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			filtered = append(filtered, entry)
+		}
+	}
+	return filtered
+}
+
+func (s *Searcher) matchCriterion(tree map[string]any, c criterion) bool {
+	if c.filter != nil {
+		return s.evalFilter(tree, c.filter)
+	}
+	if c.has != nil {
+		_, ok := s.hasTargets(c.has)[fmt.Sprintf("%v/%v", tree["resourceType"], tree["id"])]
+		return ok
+	}
+	nodes := extract(tree, c.param.Paths)
+	switch {
+	case c.chain != nil:
+		return s.matchChain(nodes, c)
+	case c.modifier == "missing":
+		return (len(nodes) == 0) == (c.values[0] == "true")
+	case c.modifier == "not":
+		return !s.matchCriterion(tree, criterion{param: c.param, values: c.values})
+	case c.param.Type == ParamReference && (c.modifier == "above" || c.modifier == "below"):
+		return s.matchHierarchy(tree, c)
+	}
+	for _, value := range c.values {
+		for _, node := range nodes {
+			if matchValue(c.param, c.modifier, node, value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (s *Searcher) matchChain(nodes []any, c criterion) bool {
+	for _, node := range nodes {
+		object, ok := node.(map[string]any)
+		if !ok {
+			continue
+		}
+		reference, _ := object["reference"].(string)
+		targetType, targetID := splitReference(reference)
+		if targetType != c.chainType {
+			continue
+		}
+		entry, err := s.store.Get(targetType, targetID)
+		if err != nil {
+			continue
+		}
+		if s.matchCriterion(resourceTree(entry.Resource), *c.chain) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Searcher) hasTargets(h *hasCriterion) map[string]struct{} {
+	if h.targets != nil {
+		return h.targets
+	}
+	h.targets = map[string]struct{}{}
+	candidates, err := s.store.List(h.source)
+	if err != nil {
+		return h.targets
+	}
+	for _, candidate := range candidates {
+		tree := resourceTree(candidate.Resource)
+		if !s.matchCriterion(tree, h.inner) {
+			continue
+		}
+		for _, node := range extract(tree, h.param.Paths) {
+			object, ok := node.(map[string]any)
+			if !ok {
+				continue
+			}
+			reference, _ := object["reference"].(string)
+			targetType, targetID := splitReference(reference)
+			if targetID != "" && allowsTarget(h.param, targetType) {
+				h.targets[targetType+"/"+targetID] = struct{}{}
+			}
+		}
+	}
+	return h.targets
+}
+
+// splitValues splits a parameter value on commas, honouring "\," escapes.
+func splitValues(value string) []string {
+	out := []string{}
+	var current strings.Builder
+	for i := 0; i < len(value); i++ {
+		switch {
+		case value[i] == '\\' && i+1 < len(value) && value[i+1] == ',':
+			current.WriteByte(',')
+			i++
+		case value[i] == ',':
+			out = append(out, current.String())
+			current.Reset()
+		default:
+			current.WriteByte(value[i])
+		}
+	}
+	return append(out, current.String())
+}
+
+func resourceTree(resource dstu3.Resource) map[string]any {
+	data, err := json.Marshal(resource)
+	if err != nil {
+		return nil
+	}
+	var tree map[string]any
+	if err := json.Unmarshal(data, &tree); err != nil {
+		return nil
+	}
+	return tree
+}
+
+func extract(tree map[string]any, paths []string) []any {
+	out := []any{}
+	for _, path := range paths {
+		out = append(out, extractPath(tree, splitPath(path))...)
+	}
+	return out
+}
+
+// splitPath splits path on the dots outside segment filters, whose values
+// may be URLs.
+func splitPath(path string) []string {
+	out := []string{}
+	depth, start := 0, 0
+	for i, c := range path {
+		switch c {
+		case '[':
+			depth++
+		case ']':
+			depth--
+		case '.':
+			if depth == 0 {
+				out = append(out, path[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(out, path[start:])
+}
+
+func extractPath(node any, path []string) []any {
+	switch typed := node.(type) {
+	case []any:
+		out := []any{}
+		for _, item := range typed {
+			out = append(out, extractPath(item, path)...)
+		}
+		return out
+	case nil:
+		return nil
+	}
+	if len(path) == 0 {
+		return []any{node}
+	}
+	object, ok := node.(map[string]any)
+	if !ok {
+		return nil
+	}
+	name, filterKey, filterValue := parseSegment(path[0])
+	child, ok := object[name]
+	if !ok {
+		return nil
+	}
+	if filterKey != "" {
+		child = filterChildren(child, filterKey, filterValue)
+	}
+	return extractPath(child, path[1:])
+}
+
+func parseSegment(segment string) (string, string, string) {
+	name, filter, ok := strings.Cut(segment, "[")
+	if !ok {
+		return segment, "", ""
+	}
+	key, value, _ := strings.Cut(strings.TrimSuffix(filter, "]"), "=")
+	return name, key, value
+}
+
+func filterChildren(node any, key, value string) any {
+	items, ok := node.([]any)
+	if !ok {
+		items = []any{node}
+	}
+	out := []any{}
+	for _, item := range items {
+		if object, ok := item.(map[string]any); ok && fmt.Sprint(object[key]) == value {
+			out = append(out, item)
+		}
+	}
+	return out
+}
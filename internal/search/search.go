@@ -5,6 +5,7 @@ import (
 	"net/url"
 	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"mini-fhir/internal/fhir/dstu3"
@@ -12,117 +13,160 @@ import (
 )
 
 type Searcher struct {
-	registry *dstu3.Registry
-	store    *store.Store
+	registry        *dstu3.Registry
+	store           store.Store
+	builtin         map[string]map[string]SearchParam
+	includeDepth    int
+	defaultPageSize int
+	maxPageSize     int
+	pages           *pageCache
+
+	// mu guards the parameter table, which adds the stored
+	// SearchParameter resources to builtin and is replaced whole when
+	// they change.
+	mu        sync.RWMutex
+	params    map[string]map[string]SearchParam
+	owners    map[string]string
+	customKey string
 }
 
+type Option func(*Searcher)
+
+// WithIncludeDepth sets how many rounds of _include:iterate and
+// _revinclude:iterate are followed.
+func WithIncludeDepth(depth int) Option {
+	return func(s *Searcher) {
+		if depth > 0 {
+			s.includeDepth = depth
+		}
+	}
+}
+
+// WithPageSize sets the page size used when _count is absent and the
+// largest page a client may ask for.
+func WithPageSize(defaultSize, maxSize int) Option {
+	return func(s *Searcher) {
+		if maxSize > 0 {
+			s.maxPageSize = maxSize
+		}
+		if defaultSize > 0 {
+			s.defaultPageSize = min(defaultSize, s.maxPageSize)
+		}
+	}
+}
+
+// SearchResult is one page of matches. Token is set when the matches span
+// several pages and names the snapshot later pages are served from.
 type SearchResult struct {
 	Entries      []*store.ResourceEntry
 	Included     []*store.ResourceEntry
 	Count        int
 	IncludeDepth int
+	Token        string
+	Offset       int
+	PageSize     int
 }
 
-func NewSearcher(registry *dstu3.Registry, store *store.Store) *Searcher {
-	return &Searcher{registry: registry, store: store}
+func NewSearcher(registry *dstu3.Registry, store store.Store, opts ...Option) *Searcher {
+	searcher := &Searcher{
+		registry:        registry,
+		store:           store,
+		builtin:         buildParams(registry),
+		includeDepth:    DefaultIncludeDepth,
+		defaultPageSize: DefaultPageSize,
+		maxPageSize:     DefaultMaxPageSize,
+		pages:           newPageCache(),
+	}
+	searcher.params = searcher.builtin
+	for _, opt := range opts {
+		opt(searcher)
+	}
+	return searcher
 }
 
 func (s *Searcher) Search(resourceType string, query url.Values) (*SearchResult, error) {
-	entries, err := s.store.List(resourceType)
+	if query.Get(PagesParam) != "" {
+		return s.Page(resourceType, query)
+	}
+	entries, err := s.Match(resourceType, query)
 	if err != nil {
 		return nil, err
 	}
+	return s.results(resourceType, []string{resourceType}, entries, query)
+}
 
-	entries = filterByProfile(entries, query.Get("_profile"))
-	entries = sortEntries(entries, query.Get("_sort"))
-	count := len(entries)
-	if countParam := query.Get("_count"); countParam != "" {
-		parsed, err := parseCount(countParam)
+// SearchSystem searches every type named in _type, or every registered
+// type when _type is absent, and pages the combined matches.
+func (s *Searcher) SearchSystem(query url.Values) (*SearchResult, error) {
+	if query.Get(PagesParam) != "" {
+		return s.Page("", query)
+	}
+	resourceTypes, err := s.systemTypes(query["_type"])
+	if err != nil {
+		return nil, err
+	}
+	criteria := url.Values{}
+	for key, values := range query {
+		if key != "_type" {
+			criteria[key] = values
+		}
+	}
+	entries := []*store.ResourceEntry{}
+	for _, resourceType := range resourceTypes {
+		matched, err := s.Match(resourceType, criteria)
 		if err != nil {
 			return nil, err
 		}
-		if parsed < len(entries) {
-			entries = entries[:parsed]
-		}
+		entries = append(entries, matched...)
 	}
+	return s.results("", resourceTypes, entries, query)
+}
 
-	includes, err := s.expandIncludes(entries, query)
+func (s *Searcher) results(snapshotType string, resourceTypes []string, entries []*store.ResourceEntry, query url.Values) (*SearchResult, error) {
+	entries, err := s.sortEntries(resourceTypes, entries, query.Get("_sort"))
 	if err != nil {
 		return nil, err
 	}
-
-	return &SearchResult{Entries: entries, Included: includes, Count: count, IncludeDepth: 2}, nil
+	return s.page(snapshotType, entries, query)
 }
 
-func filterByProfile(entries []*store.ResourceEntry, profile string) []*store.ResourceEntry {
-	if profile == "" {
-		return entries
+func (s *Searcher) systemTypes(values []string) ([]string, error) {
+	if len(values) == 0 {
+		resourceTypes := s.registry.ResourceTypes()
+		sort.Strings(resourceTypes)
+		return resourceTypes, nil
 	}
-	filtered := make([]*store.ResourceEntry, 0, len(entries))
-	for _, entry := range entries {
-		meta := entry.Resource.GetMeta()
-		if meta == nil {
-			continue
-		}
-		for _, p := range meta.Profile {
-			if p == profile {
-				filtered = append(filtered, entry)
-				break
+	resourceTypes := []string{}
+	seen := map[string]struct{}{}
+	for _, value := range values {
+		for _, resourceType := range strings.Split(value, ",") {
+			resourceType = strings.TrimSpace(resourceType)
+			if _, ok := s.paramTable()[resourceType]; !ok {
+				return nil, fmt.Errorf("unsupported resource type in _type: %q", resourceType)
 			}
+			if _, ok := seen[resourceType]; ok {
+				continue
+			}
+			seen[resourceType] = struct{}{}
+			resourceTypes = append(resourceTypes, resourceType)
 		}
 	}
-	return filtered
+	return resourceTypes, nil
 }
 
-func sortEntries(entries []*store.ResourceEntry, sortParam string) []*store.ResourceEntry {
-	if sortParam == "" {
-		return entries
-	}
-	fields := strings.Split(sortParam, ",")
-	if len(fields) == 0 {
-		return entries
-	}
-	field := strings.TrimSpace(fields[0])
-	if field == "" {
-		return entries
-	}
-	desc := false
-	if strings.HasPrefix(field, "-") {
-		desc = true
-		field = strings.TrimPrefix(field, "-")
+// Match returns every current resource of resourceType that satisfies the
+// filter parameters in query, ignoring sorting, paging and includes.
+func (s *Searcher) Match(resourceType string, query url.Values) ([]*store.ResourceEntry, error) {
+	s.syncCustomParams()
+	criteria, err := s.parseCriteria(resourceType, query)
+	if err != nil {
+		return nil, err
 	}
-
-	sort.SliceStable(entries, func(i, j int) bool {
-		left := sortValue(entries[i], field)
-		right := sortValue(entries[j], field)
-		if desc {
-			return left > right
-		}
-		return left < right
-	})
-	return entries
-}
-
-func sortValue(entry *store.ResourceEntry, field string) string {
-	switch field {
-	case "_lastUpdated":
-		return entry.LastUpdated
-	case "id":
-		return entry.Resource.GetID()
-	case "date":
-		if obs, ok := entry.Resource.(*dstu3.Observation); ok {
-			if obs.EffectiveDateTime != nil {
-				return *obs.EffectiveDateTime
-			}
-			if obs.EffectivePeriod != nil {
-				return obs.EffectivePeriod.Start
-			}
-			return obs.Issued
-		}
-		return ""
-	default:
-		return ""
+	entries, err := s.store.List(resourceType)
+	if err != nil {
+		return nil, err
 	}
+	return s.filter(entries, criteria), nil
 }
 
 func parseCount(count string) (int, error) {
@@ -134,50 +178,6 @@ func parseCount(count string) (int, error) {
 	return parsed, nil
 }
 
-func (s *Searcher) expandIncludes(entries []*store.ResourceEntry, query url.Values) ([]*store.ResourceEntry, error) {
-	include := query["_include"]
-	includeIterate := query["_include:iterate"]
-	if len(include) == 0 && len(includeIterate) == 0 {
-		return nil, nil
-	}
-	seen := map[string]struct{}{}
-	result := []*store.ResourceEntry{}
-	if err := s.expand(entries, 1, 2, seen, &result); err != nil {
-		return nil, err
-	}
-	if len(includeIterate) > 0 {
-		if err := s.expand(result, 2, 2, seen, &result); err != nil {
-			return nil, err
-		}
-	}
-	return result, nil
-}
-
-func (s *Searcher) expand(entries []*store.ResourceEntry, depth int, maxDepth int, seen map[string]struct{}, result *[]*store.ResourceEntry) error {
-	if depth > maxDepth {
-		return nil
-	}
-	for _, entry := range entries {
-		for _, ref := range entry.Resource.References() {
-			parts := strings.Split(ref.Reference, "/")
-			if len(parts) != 2 {
-				continue
-			}
-			key := parts[0] + "/" + parts[1]
-			if _, ok := seen[key]; ok {
-				continue
-			}
-			included, err := s.store.Get(parts[0], parts[1])
-			if err != nil {
-				continue
-			}
-			seen[key] = struct{}{}
-			*result = append(*result, included)
-		}
-	}
-	return nil
-}
-
 func parseFHIRTime(value string) (time.Time, bool) {
 	if value == "" {
 		return time.Time{}, false
@@ -1,7 +1,9 @@
 package search
 
 import (
+	"errors"
 	"net/url"
+	"strings"
 	"testing"
 
 	"mini-fhir/internal/fhir/dstu3"
@@ -10,21 +12,24 @@ import (
 
 func TestObservationSortDateDescending(t *testing.T) {
 	registry := dstu3.NewRegistry()
-	store := store.NewStore()
+	store := store.NewMemoryStore()
 	searcher := NewSearcher(registry, store)
 
+	firstDate, secondDate := "2023-01-01T00:00:00Z", "2024-01-01T00:00:00Z"
 	first := &dstu3.Observation{
-		ResourceBase: dstu3.ResourceBase{ResourceType: "Observation", ID: "obs-1"},
-		Issued:       "2023-01-01T00:00:00Z",
+		ResourceBase:      dstu3.ResourceBase{ResourceType: "Observation", ID: "obs-1"},
+		EffectiveDateTime: &firstDate,
+		Issued:            "2025-01-01T00:00:00Z",
 	}
 	second := &dstu3.Observation{
-		ResourceBase: dstu3.ResourceBase{ResourceType: "Observation", ID: "obs-2"},
-		Issued:       "2024-01-01T00:00:00Z",
+		ResourceBase:      dstu3.ResourceBase{ResourceType: "Observation", ID: "obs-2"},
+		EffectiveDateTime: &secondDate,
+		Issued:            "2020-01-01T00:00:00Z",
 	}
-	if _, err := store.Update(first); err != nil {
+	if _, err := store.Update(first, ""); err != nil {
 		t.Fatalf("store update failed: %v", err)
 	}
-	if _, err := store.Update(second); err != nil {
+	if _, err := store.Update(second, ""); err != nil {
 		t.Fatalf("store update failed: %v", err)
 	}
 
@@ -43,15 +48,15 @@ func TestObservationSortDateDescending(t *testing.T) {
 
 func TestIncludeExpand(t *testing.T) {
 	registry := dstu3.NewRegistry()
-	store := store.NewStore()
+	store := store.NewMemoryStore()
 	searcher := NewSearcher(registry, store)
 
 	org := &dstu3.Organization{ResourceBase: dstu3.ResourceBase{ResourceType: "Organization", ID: "org-1"}}
 	patient := &dstu3.Patient{ResourceBase: dstu3.ResourceBase{ResourceType: "Patient", ID: "pat-1"}, ManagingOrganization: &dstu3.Reference{Reference: "Organization/org-1"}}
-	if _, err := store.Update(org); err != nil {
+	if _, err := store.Update(org, ""); err != nil {
 		t.Fatalf("store update failed: %v", err)
 	}
-	if _, err := store.Update(patient); err != nil {
+	if _, err := store.Update(patient, ""); err != nil {
 		t.Fatalf("store update failed: %v", err)
 	}
 
@@ -64,3 +69,666 @@ func TestIncludeExpand(t *testing.T) {
 		t.Fatalf("expected 1 included resource, got %d", len(result.Included))
 	}
 }
+
+func TestIncludeFollowsParameterAndIterates(t *testing.T) {
+	registry := dstu3.NewRegistry()
+	store := store.NewMemoryStore()
+
+	resources := []dstu3.Resource{
+		&dstu3.Organization{ResourceBase: dstu3.ResourceBase{ResourceType: "Organization", ID: "org-1"}, PartOf: &dstu3.Reference{Reference: "Organization/org-2"}},
+		&dstu3.Organization{ResourceBase: dstu3.ResourceBase{ResourceType: "Organization", ID: "org-2"}, PartOf: &dstu3.Reference{Reference: "Organization/org-1"}},
+		&dstu3.Practitioner{ResourceBase: dstu3.ResourceBase{ResourceType: "Practitioner", ID: "prac-1"}},
+		&dstu3.Patient{
+			ResourceBase:         dstu3.ResourceBase{ResourceType: "Patient", ID: "pat-1"},
+			ManagingOrganization: &dstu3.Reference{Reference: "Organization/org-1"},
+			GeneralPractitioner:  []dstu3.Reference{{Reference: "Practitioner/prac-1"}},
+		},
+		&dstu3.Observation{ResourceBase: dstu3.ResourceBase{ResourceType: "Observation", ID: "obs-1"}, Subject: &dstu3.Reference{Reference: "Patient/pat-1"}},
+	}
+	for _, resource := range resources {
+		if _, err := store.Update(resource, ""); err != nil {
+			t.Fatalf("store update failed: %v", err)
+		}
+	}
+
+	includedIDs := func(searcher *Searcher, resourceType, rawQuery string) string {
+		query, _ := url.ParseQuery(rawQuery)
+		result, err := searcher.Search(resourceType, query)
+		if err != nil {
+			t.Fatalf("%s: search failed: %v", rawQuery, err)
+		}
+		ids := []string{}
+		for _, entry := range result.Included {
+			ids = append(ids, entry.Resource.GetID())
+		}
+		return strings.Join(ids, ",")
+	}
+
+	searcher := NewSearcher(registry, store)
+	if got := includedIDs(searcher, "Patient", "_include=Patient:organization"); got != "org-1" {
+		t.Fatalf("expected only the organization, got %q", got)
+	}
+	if got := includedIDs(searcher, "Patient", "_include=Patient:general-practitioner:Organization"); got != "" {
+		t.Fatalf("expected target type to filter includes, got %q", got)
+	}
+	if got := includedIDs(searcher, "Observation", "_include=Patient:organization"); got != "" {
+		t.Fatalf("expected include for another source type to be ignored, got %q", got)
+	}
+
+	iterate := "_include=Observation:subject&_include:iterate=Patient:organization&_include:iterate=Organization:partof"
+	if got := includedIDs(searcher, "Observation", iterate); got != "pat-1,org-1" {
+		t.Fatalf("expected default depth to stop after two rounds, got %q", got)
+	}
+	deep := NewSearcher(registry, store, WithIncludeDepth(10))
+	if got := includedIDs(deep, "Observation", iterate); got != "pat-1,org-1,org-2" {
+		t.Fatalf("expected iterate to follow the partof cycle once, got %q", got)
+	}
+
+	if _, err := searcher.Search("Patient", url.Values{"_include": {"Patient:gender"}}); err == nil {
+		t.Fatalf("expected non-reference _include to be rejected")
+	}
+}
+
+func TestTypedSearchParameters(t *testing.T) {
+	registry := dstu3.NewRegistry()
+	store := store.NewMemoryStore()
+	searcher := NewSearcher(registry, store)
+
+	smith := &dstu3.Patient{
+		ResourceBase: dstu3.ResourceBase{ResourceType: "Patient", ID: "pat-1"},
+		Identifier:   []dstu3.Identifier{{System: "urn:mrn", Value: "123"}},
+		Name:         []dstu3.HumanName{{Family: []string{"Smith"}, Given: []string{"Anna"}}},
+		Gender:       "female",
+		BirthDate:    "1980-05-17",
+	}
+	jones := &dstu3.Patient{
+		ResourceBase: dstu3.ResourceBase{ResourceType: "Patient", ID: "pat-2"},
+		Name:         []dstu3.HumanName{{Family: []string{"Jones"}}},
+		Gender:       "male",
+		BirthDate:    "1975",
+	}
+	effective := "2024-03-10T12:00:00Z"
+	obs := &dstu3.Observation{
+		ResourceBase:      dstu3.ResourceBase{ResourceType: "Observation", ID: "obs-1"},
+		Code:              dstu3.CodeableConcept{Coding: []dstu3.Coding{{System: "http://loinc.org", Code: "1234-5"}}},
+		Subject:           &dstu3.Reference{Reference: "Patient/pat-1"},
+		EffectiveDateTime: &effective,
+	}
+	for _, resource := range []dstu3.Resource{smith, jones, obs} {
+		if _, err := store.Update(resource, ""); err != nil {
+			t.Fatalf("store update failed: %v", err)
+		}
+	}
+
+	cases := []struct {
+		resourceType string
+		query        string
+		want         []string
+	}{
+		{"Patient", "family=smi", []string{"pat-1"}},
+		{"Patient", "name=ANNA", []string{"pat-1"}},
+		{"Patient", "family=smith,jones", []string{"pat-1", "pat-2"}},
+		{"Patient", "gender=male", []string{"pat-2"}},
+		{"Patient", "identifier=urn:mrn|123", []string{"pat-1"}},
+		{"Patient", "identifier=other|123", nil},
+		{"Patient", "birthdate=1980", []string{"pat-1"}},
+		{"Patient", "birthdate=ge1976-01-01", []string{"pat-1"}},
+		{"Patient", "birthdate=lt1976", []string{"pat-2"}},
+		{"Patient", "birthdate=ge1970&birthdate=le1979", []string{"pat-2"}},
+		{"Observation", "code=http://loinc.org|1234-5", []string{"obs-1"}},
+		{"Observation", "code=|1234-5", nil},
+		{"Observation", "subject=Patient/pat-1", []string{"obs-1"}},
+		{"Observation", "subject=pat-1", []string{"obs-1"}},
+		{"Observation", "subject:Patient=pat-1", []string{"obs-1"}},
+		{"Observation", "subject:Organization=pat-1", nil},
+		{"Observation", "date=2024-03", []string{"obs-1"}},
+		{"Observation", "date=sa2024-03-10", nil},
+		{"Observation", "date=gt2024-03-09", []string{"obs-1"}},
+	}
+	for _, tc := range cases {
+		expectIDs(t, searcher, tc.resourceType, tc.query, tc.want)
+	}
+
+	if _, err := searcher.Search("Patient", url.Values{"unknown": {"x"}}); err == nil {
+		t.Fatalf("expected unknown parameter to be rejected")
+	}
+}
+
+func TestQuantityAndNumberMatching(t *testing.T) {
+	param := SearchParam{Code: "value-quantity", Type: ParamQuantity}
+	node := map[string]any{"value": 5.4, "unit": "mg", "system": "http://unitsofmeasure.org", "code": "mg"}
+	cases := map[string]bool{
+		"5.4":                              true,
+		"5.41":                             false,
+		"5":                                true,
+		"gt5":                              true,
+		"lt5":                              false,
+		"ap5":                              true,
+		"5.4|http://unitsofmeasure.org|mg": true,
+		"5.4||mg":                          true,
+		"5.4|http://unitsofmeasure.org|kg": false,
+	}
+	for value, want := range cases {
+		if got := matchValue(param, "", node, value); got != want {
+			t.Fatalf("quantity %q: expected %v, got %v", value, want, got)
+		}
+	}
+}
+
+func TestStandardSearchParameters(t *testing.T) {
+	registry := dstu3.NewRegistry()
+	store := store.NewMemoryStore()
+	searcher := NewSearcher(registry, store)
+
+	resources := []dstu3.Resource{
+		&dstu3.Patient{
+			ResourceBase:         dstu3.ResourceBase{ResourceType: "Patient", ID: "pat-1"},
+			Telecom:              []dstu3.ContactPoint{{System: "phone", Value: "555-0100"}, {System: "email", Value: "anna@example.org"}},
+			Address:              []dstu3.Address{{City: "Springfield", PostalCode: "12345"}},
+			ManagingOrganization: &dstu3.Reference{Reference: "Organization/org-1"},
+			GeneralPractitioner:  []dstu3.Reference{{Reference: "Practitioner/prac-1"}},
+		},
+		&dstu3.Observation{
+			ResourceBase: dstu3.ResourceBase{ResourceType: "Observation", ID: "obs-1"},
+			Subject:      &dstu3.Reference{Reference: "Patient/pat-1"},
+			Performer:    []dstu3.Reference{{Reference: "Practitioner/prac-1"}},
+		},
+		&dstu3.Observation{
+			ResourceBase: dstu3.ResourceBase{ResourceType: "Observation", ID: "obs-2"},
+			Subject:      &dstu3.Reference{Reference: "Location/loc-1"},
+		},
+		&dstu3.Task{
+			ResourceBase: dstu3.ResourceBase{ResourceType: "Task", ID: "task-1"},
+			Status:       "requested",
+			For:          &dstu3.Reference{Reference: "Patient/pat-1"},
+			Owner:        &dstu3.Reference{Reference: "Practitioner/prac-1"},
+			Requester:    &dstu3.Reference{Reference: "Organization/org-1"},
+			Focus:        &dstu3.Reference{Reference: "Observation/obs-1"},
+		},
+		&dstu3.Consent{
+			ResourceBase: dstu3.ResourceBase{ResourceType: "Consent", ID: "consent-1"},
+			Status:       "active",
+			Patient:      &dstu3.Reference{Reference: "Patient/pat-1"},
+			Actor:        []dstu3.ConsentActor{{Reference: dstu3.Reference{Reference: "Practitioner/prac-1"}}},
+		},
+		&dstu3.Flag{
+			ResourceBase: dstu3.ResourceBase{ResourceType: "Flag", ID: "flag-1"},
+			Status:       "active",
+			Subject:      &dstu3.Reference{Reference: "Patient/pat-1"},
+			Author:       &dstu3.Reference{Reference: "Practitioner/prac-1"},
+		},
+		&dstu3.Location{
+			ResourceBase:         dstu3.ResourceBase{ResourceType: "Location", ID: "loc-1"},
+			Name:                 "General Hospital",
+			Status:               "active",
+			ManagingOrganization: &dstu3.Reference{Reference: "Organization/org-1"},
+		},
+		&dstu3.Location{
+			ResourceBase: dstu3.ResourceBase{ResourceType: "Location", ID: "loc-2"},
+			Name:         "Ward 3",
+			Status:       "suspended",
+			PartOf:       &dstu3.Reference{Reference: "Location/loc-1"},
+		},
+	}
+	for _, resource := range resources {
+		if _, err := store.Update(resource, ""); err != nil {
+			t.Fatalf("store update failed: %v", err)
+		}
+	}
+
+	cases := []struct {
+		resourceType string
+		query        string
+		want         []string
+	}{
+		{"Patient", "phone=555-0100", []string{"pat-1"}},
+		{"Patient", "email=555-0100", nil},
+		{"Patient", "address-city=spring", []string{"pat-1"}},
+		{"Patient", "organization=Organization/org-1", []string{"pat-1"}},
+		{"Patient", "general-practitioner=prac-1", []string{"pat-1"}},
+		{"Observation", "patient=pat-1", []string{"obs-1"}},
+		{"Observation", "patient=loc-1", nil},
+		{"Observation", "subject=loc-1", []string{"obs-2"}},
+		{"Observation", "performer=Practitioner/prac-1", []string{"obs-1"}},
+		{"Task", "status=requested&for=Patient/pat-1&owner=prac-1", []string{"task-1"}},
+		{"Task", "requester=org-1&focus=Observation/obs-1", []string{"task-1"}},
+		{"Consent", "patient=pat-1&status=active&actor=Practitioner/prac-1", []string{"consent-1"}},
+		{"Flag", "subject=Patient/pat-1&status=active&author=prac-1", []string{"flag-1"}},
+		{"Location", "name=general", []string{"loc-1"}},
+		{"Location", "status=suspended&partof=loc-1", []string{"loc-2"}},
+		{"Location", "organization=org-1", []string{"loc-1"}},
+	}
+	for _, tc := range cases {
+		expectIDs(t, searcher, tc.resourceType, tc.query, tc.want)
+	}
+}
+
+func expectIDs(t *testing.T, searcher *Searcher, resourceType, rawQuery string, want []string) {
+	t.Helper()
+	query, _ := url.ParseQuery(rawQuery)
+	result, err := searcher.Search(resourceType, query)
+	if err != nil {
+		t.Fatalf("%s?%s: search failed: %v", resourceType, rawQuery, err)
+	}
+	got := []string{}
+	for _, entry := range result.Entries {
+		got = append(got, entry.Resource.GetID())
+	}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Fatalf("%s?%s: expected %v, got %v", resourceType, rawQuery, want, got)
+	}
+}
+
+func TestChainedSearchParameters(t *testing.T) {
+	registry := dstu3.NewRegistry()
+	store := store.NewMemoryStore()
+	searcher := NewSearcher(registry, store)
+
+	resources := []dstu3.Resource{
+		&dstu3.Organization{ResourceBase: dstu3.ResourceBase{ResourceType: "Organization", ID: "org-1"}, Name: "Acme Health"},
+		&dstu3.Patient{
+			ResourceBase:         dstu3.ResourceBase{ResourceType: "Patient", ID: "pat-1"},
+			Identifier:           []dstu3.Identifier{{System: "mrn", Value: "123"}},
+			ManagingOrganization: &dstu3.Reference{Reference: "Organization/org-1"},
+		},
+		&dstu3.Patient{
+			ResourceBase: dstu3.ResourceBase{ResourceType: "Patient", ID: "pat-2"},
+			Identifier:   []dstu3.Identifier{{System: "mrn", Value: "456"}},
+		},
+		&dstu3.Observation{ResourceBase: dstu3.ResourceBase{ResourceType: "Observation", ID: "obs-1"}, Subject: &dstu3.Reference{Reference: "Patient/pat-1"}},
+		&dstu3.Observation{ResourceBase: dstu3.ResourceBase{ResourceType: "Observation", ID: "obs-2"}, Subject: &dstu3.Reference{Reference: "Patient/pat-2"}},
+		&dstu3.Practitioner{ResourceBase: dstu3.ResourceBase{ResourceType: "Practitioner", ID: "prac-1"}, Name: []dstu3.HumanName{{Family: []string{"Jones"}}}},
+		&dstu3.PractitionerRole{ResourceBase: dstu3.ResourceBase{ResourceType: "PractitionerRole", ID: "role-1"}, Practitioner: &dstu3.Reference{Reference: "Practitioner/prac-1"}},
+	}
+	for _, resource := range resources {
+		if _, err := store.Update(resource, ""); err != nil {
+			t.Fatalf("store update failed: %v", err)
+		}
+	}
+
+	expectIDs(t, searcher, "Observation", "subject:Patient.identifier=mrn|123", []string{"obs-1"})
+	expectIDs(t, searcher, "Observation", "patient.identifier=456", []string{"obs-2"})
+	expectIDs(t, searcher, "PractitionerRole", "practitioner.name=Jones", []string{"role-1"})
+	expectIDs(t, searcher, "PractitionerRole", "practitioner.name=Smith", nil)
+	expectIDs(t, searcher, "Observation", "subject:Patient.organization.name=acme", []string{"obs-1"})
+
+	for _, rawQuery := range []string{"subject.identifier=123", "subject:Patient.gender.name=x", "subject:Patient.unknown=x"} {
+		query, _ := url.ParseQuery(rawQuery)
+		if _, err := searcher.Search("Observation", query); err == nil {
+			t.Fatalf("expected %s to be rejected", rawQuery)
+		}
+	}
+}
+
+func TestRevInclude(t *testing.T) {
+	registry := dstu3.NewRegistry()
+	store := store.NewMemoryStore()
+	searcher := NewSearcher(registry, store)
+
+	resources := []dstu3.Resource{
+		&dstu3.Patient{ResourceBase: dstu3.ResourceBase{ResourceType: "Patient", ID: "pat-1"}},
+		&dstu3.Patient{ResourceBase: dstu3.ResourceBase{ResourceType: "Patient", ID: "pat-2"}},
+		&dstu3.Observation{ResourceBase: dstu3.ResourceBase{ResourceType: "Observation", ID: "obs-1"}, Subject: &dstu3.Reference{Reference: "Patient/pat-1"}},
+		&dstu3.Observation{ResourceBase: dstu3.ResourceBase{ResourceType: "Observation", ID: "obs-2"}, Subject: &dstu3.Reference{Reference: "Patient/pat-2"}},
+		&dstu3.Task{ResourceBase: dstu3.ResourceBase{ResourceType: "Task", ID: "task-1"}, Focus: &dstu3.Reference{Reference: "Observation/obs-1"}},
+	}
+	for _, resource := range resources {
+		if _, err := store.Update(resource, ""); err != nil {
+			t.Fatalf("store update failed: %v", err)
+		}
+	}
+
+	includedIDs := func(rawQuery string) string {
+		query, _ := url.ParseQuery(rawQuery)
+		result, err := searcher.Search("Patient", query)
+		if err != nil {
+			t.Fatalf("%s: search failed: %v", rawQuery, err)
+		}
+		ids := []string{}
+		for _, entry := range result.Included {
+			ids = append(ids, entry.Resource.GetID())
+		}
+		return strings.Join(ids, ",")
+	}
+
+	if got := includedIDs("_id=pat-1&_revinclude=Observation:subject"); got != "obs-1" {
+		t.Fatalf("expected obs-1 to be included, got %q", got)
+	}
+	if got := includedIDs("_id=pat-1&_revinclude=Observation:subject:Location"); got != "" {
+		t.Fatalf("expected target type to restrict includes, got %q", got)
+	}
+	if got := includedIDs("_id=pat-1&_revinclude=Observation:subject&_revinclude:iterate=Task:focus"); got != "obs-1,task-1" {
+		t.Fatalf("expected iterate to follow observations to tasks, got %q", got)
+	}
+	if _, err := searcher.Search("Patient", url.Values{"_revinclude": {"Observation:status"}}); err == nil {
+		t.Fatalf("expected non-reference _revinclude to be rejected")
+	}
+}
+
+func TestMultiKeySort(t *testing.T) {
+	registry := dstu3.NewRegistry()
+	store := store.NewMemoryStore()
+	searcher := NewSearcher(registry, store)
+
+	patient := func(id, family, birthDate string) *dstu3.Patient {
+		p := &dstu3.Patient{ResourceBase: dstu3.ResourceBase{ResourceType: "Patient", ID: id}, BirthDate: birthDate}
+		if family != "" {
+			p.Name = []dstu3.HumanName{{Family: []string{family}}}
+		}
+		return p
+	}
+	for _, resource := range []dstu3.Resource{
+		patient("pat-a", "Smith", "1980-05-17"),
+		patient("pat-b", "smith", "1980"),
+		patient("pat-c", "Adams", "1990-01-01"),
+		patient("pat-d", "Smith", "1980-05-17"),
+		patient("pat-e", "", ""),
+	} {
+		if _, err := store.Update(resource, ""); err != nil {
+			t.Fatalf("store update failed: %v", err)
+		}
+	}
+
+	expectIDs(t, searcher, "Patient", "_sort=family,-birthdate", []string{"pat-c", "pat-b", "pat-a", "pat-d", "pat-e"})
+	expectIDs(t, searcher, "Patient", "_sort=birthdate", []string{"pat-b", "pat-a", "pat-d", "pat-c", "pat-e"})
+	expectIDs(t, searcher, "Patient", "_sort=-family,_id", []string{"pat-a", "pat-b", "pat-d", "pat-c", "pat-e"})
+	expectIDs(t, searcher, "Patient", "_sort=-id", []string{"pat-e", "pat-d", "pat-c", "pat-b", "pat-a"})
+	expectIDs(t, searcher, "Patient", "_sort=-_lastUpdated", []string{"pat-e", "pat-d", "pat-c", "pat-b", "pat-a"})
+
+	if _, err := searcher.Search("Patient", url.Values{"_sort": {"shoe-size"}}); err == nil {
+		t.Fatalf("expected unknown _sort parameter to be rejected")
+	}
+}
+
+func TestHasReverseChaining(t *testing.T) {
+	registry := dstu3.NewRegistry()
+	store := store.NewMemoryStore()
+	searcher := NewSearcher(registry, store)
+
+	loinc := func(code string) dstu3.CodeableConcept {
+		return dstu3.CodeableConcept{Coding: []dstu3.Coding{{System: "http://loinc.org", Code: code}}}
+	}
+	resources := []dstu3.Resource{
+		&dstu3.Patient{ResourceBase: dstu3.ResourceBase{ResourceType: "Patient", ID: "pat-1"}},
+		&dstu3.Patient{ResourceBase: dstu3.ResourceBase{ResourceType: "Patient", ID: "pat-2"}},
+		&dstu3.Patient{ResourceBase: dstu3.ResourceBase{ResourceType: "Patient", ID: "pat-3"}},
+		&dstu3.Observation{ResourceBase: dstu3.ResourceBase{ResourceType: "Observation", ID: "obs-1"}, Code: loinc("1234-5"), Subject: &dstu3.Reference{Reference: "Patient/pat-1"}},
+		&dstu3.Observation{ResourceBase: dstu3.ResourceBase{ResourceType: "Observation", ID: "obs-2"}, Code: loinc("9999-9"), Subject: &dstu3.Reference{Reference: "Patient/pat-2"}},
+		&dstu3.Flag{ResourceBase: dstu3.ResourceBase{ResourceType: "Flag", ID: "flag-1"}, Status: "active", Subject: &dstu3.Reference{Reference: "Patient/pat-2"}},
+		&dstu3.Flag{ResourceBase: dstu3.ResourceBase{ResourceType: "Flag", ID: "flag-2"}, Status: "inactive", Subject: &dstu3.Reference{Reference: "Patient/pat-3"}},
+		&dstu3.Task{ResourceBase: dstu3.ResourceBase{ResourceType: "Task", ID: "task-1"}, Status: "requested", Focus: &dstu3.Reference{Reference: "Observation/obs-2"}},
+	}
+	for _, resource := range resources {
+		if _, err := store.Update(resource, ""); err != nil {
+			t.Fatalf("store update failed: %v", err)
+		}
+	}
+
+	expectIDs(t, searcher, "Patient", "_has:Observation:patient:code=1234-5", []string{"pat-1"})
+	expectIDs(t, searcher, "Patient", "_has:Observation:patient:code=1234-5,9999-9", []string{"pat-1", "pat-2"})
+	expectIDs(t, searcher, "Patient", "_has:Flag:subject:status=active", []string{"pat-2"})
+	expectIDs(t, searcher, "Patient", "_has:Flag:subject:status=active&_has:Observation:patient:code=1234-5", nil)
+	expectIDs(t, searcher, "Patient", "_has:Observation:subject:_has:Task:focus:status=requested", []string{"pat-2"})
+
+	for _, rawQuery := range []string{"_has:Observation:status:code=x", "_has:Observation=x", "_has:Location:partof:name=x"} {
+		query, _ := url.ParseQuery(rawQuery)
+		if _, err := searcher.Search("Patient", query); err == nil {
+			t.Fatalf("expected %s to be rejected", rawQuery)
+		}
+	}
+}
+
+func TestSearchModifiers(t *testing.T) {
+	registry := dstu3.NewRegistry()
+	store := store.NewMemoryStore()
+	searcher := NewSearcher(registry, store)
+
+	resources := []dstu3.Resource{
+		&dstu3.Location{ResourceBase: dstu3.ResourceBase{ResourceType: "Location", ID: "hospital"}, Name: "General Hospital", Status: "active"},
+		&dstu3.Location{ResourceBase: dstu3.ResourceBase{ResourceType: "Location", ID: "wing"}, Name: "East Wing", Status: "active", PartOf: &dstu3.Reference{Reference: "Location/hospital"}},
+		&dstu3.Location{ResourceBase: dstu3.ResourceBase{ResourceType: "Location", ID: "ward"}, Name: "Ward 3", Status: "suspended", PartOf: &dstu3.Reference{Reference: "Location/wing"}},
+		&dstu3.Location{ResourceBase: dstu3.ResourceBase{ResourceType: "Location", ID: "clinic"}, Name: "Clinic"},
+		&dstu3.Observation{
+			ResourceBase: dstu3.ResourceBase{ResourceType: "Observation", ID: "obs-1", Meta: &dstu3.Meta{Profile: []string{"http://example.org/fhir/StructureDefinition/vitals"}}},
+			Code:         dstu3.CodeableConcept{Coding: []dstu3.Coding{{System: "http://loinc.org", Code: "2339-0", Display: "Glucose"}}},
+		},
+	}
+	for _, resource := range resources {
+		if _, err := store.Update(resource, ""); err != nil {
+			t.Fatalf("store update failed: %v", err)
+		}
+	}
+
+	expectIDs(t, searcher, "Location", "partof:below=Location/hospital", []string{"hospital", "ward", "wing"})
+	expectIDs(t, searcher, "Location", "partof:below=wing", []string{"ward", "wing"})
+	expectIDs(t, searcher, "Location", "partof:above=Location/wing", []string{"hospital", "wing"})
+	expectIDs(t, searcher, "Location", "partof:above=clinic", []string{"clinic"})
+	expectIDs(t, searcher, "Location", "partof:missing=true", []string{"clinic", "hospital"})
+	expectIDs(t, searcher, "Location", "status:missing=false&status:not=active", []string{"ward"})
+	expectIDs(t, searcher, "Location", "status:not=active", []string{"clinic", "ward"})
+	expectIDs(t, searcher, "Location", "name:exact=General Hospital", []string{"hospital"})
+	expectIDs(t, searcher, "Location", "name:exact=general hospital", nil)
+	expectIDs(t, searcher, "Location", "name:contains=WING", []string{"wing"})
+	expectIDs(t, searcher, "Observation", "code:text=gluc", []string{"obs-1"})
+	expectIDs(t, searcher, "Observation", "_profile:below=http://example.org/fhir/", []string{"obs-1"})
+
+	for _, rawQuery := range []string{"status:exact=active", "name:not=x", "name:missing=maybe", "organization:below=Organization/org-1"} {
+		query, _ := url.ParseQuery(rawQuery)
+		if _, err := searcher.Search("Location", query); err == nil {
+			t.Fatalf("expected %s to be rejected", rawQuery)
+		}
+	}
+}
+
+func TestFilterParameter(t *testing.T) {
+	registry := dstu3.NewRegistry()
+	store := store.NewMemoryStore()
+	searcher := NewSearcher(registry, store)
+
+	resources := []dstu3.Resource{
+		&dstu3.Organization{ResourceBase: dstu3.ResourceBase{ResourceType: "Organization", ID: "org-1"}, Name: "Acme Health"},
+		&dstu3.Patient{
+			ResourceBase:         dstu3.ResourceBase{ResourceType: "Patient", ID: "pat-1"},
+			Name:                 []dstu3.HumanName{{Family: []string{"Smith"}}},
+			BirthDate:            "1985-02-01",
+			Gender:               "female",
+			ManagingOrganization: &dstu3.Reference{Reference: "Organization/org-1"},
+		},
+		&dstu3.Patient{
+			ResourceBase: dstu3.ResourceBase{ResourceType: "Patient", ID: "pat-2"},
+			Name:         []dstu3.HumanName{{Family: []string{"Goldsmith"}}},
+			BirthDate:    "1970-07-01",
+			Gender:       "male",
+		},
+		&dstu3.Patient{
+			ResourceBase: dstu3.ResourceBase{ResourceType: "Patient", ID: "pat-3"},
+			Name:         []dstu3.HumanName{{Family: []string{"Jones"}}},
+			BirthDate:    "1990",
+		},
+	}
+	for _, resource := range resources {
+		if _, err := store.Update(resource, ""); err != nil {
+			t.Fatalf("store update failed: %v", err)
+		}
+	}
+
+	cases := map[string][]string{
+		`name co "smi" and birthdate ge 1980-01-01`: {"pat-1"},
+		`name co "smi"`:                                              {"pat-1", "pat-2"},
+		`family sw smi or family ew "ES"`:                            {"pat-1", "pat-3"},
+		`not (gender eq female) and gender pr true`:                  {"pat-2"},
+		`gender pr false`:                                            {"pat-3"},
+		`(gender eq male or gender eq female) and birthdate lt 1980`: {"pat-2"},
+		`gender ne male`:                                             {"pat-1", "pat-3"},
+		`birthdate po 1990-06-01`:                                    {"pat-3"},
+		`organization.name eq "acme health"`:                         {"pat-1"},
+		`organization[name sw acme].name co health`:                  {"pat-1"},
+		`organization re Organization/org-1`:                         {"pat-1"},
+	}
+	for expression, want := range cases {
+		expectIDs(t, searcher, "Patient", url.Values{"_filter": {expression}}.Encode(), want)
+	}
+
+	errorsAt := map[string]int{
+		`name co "smi" and`:               18,
+		`name xx "smi"`:                   6,
+		`(name co smi`:                    13,
+		`shoe eq 1`:                       1,
+		`name co "smi`:                    9,
+		`name eq smi ) or gender eq male`: 13,
+		`birthdate gt notadate`:           14,
+		`name gt smi`:                     6,
+		`birthdate co 1990`:               11,
+	}
+	for expression, pos := range errorsAt {
+		_, err := searcher.Search("Patient", url.Values{"_filter": {expression}})
+		var filterErr *FilterError
+		if !errors.As(err, &filterErr) || filterErr.Pos != pos {
+			t.Fatalf("%s: expected error at position %d, got %v", expression, pos, err)
+		}
+	}
+}
+
+func TestCustomSearchParameters(t *testing.T) {
+	registry := dstu3.NewRegistry()
+	store := store.NewMemoryStore()
+	searcher := NewSearcher(registry, store)
+
+	eyeColour := func(code string) []dstu3.Extension {
+		return []dstu3.Extension{{URL: "http://example.org/fhir/eye-colour", ValueCode: code}}
+	}
+	resources := []dstu3.Resource{
+		&dstu3.Patient{ResourceBase: dstu3.ResourceBase{ResourceType: "Patient", ID: "pat-1", Extension: eyeColour("blue")}},
+		&dstu3.Patient{ResourceBase: dstu3.ResourceBase{ResourceType: "Patient", ID: "pat-2", Extension: eyeColour("green")}, Telecom: []dstu3.ContactPoint{{System: "phone", Use: "work", Value: "555-0100"}}},
+		&dstu3.Patient{ResourceBase: dstu3.ResourceBase{ResourceType: "Patient", ID: "pat-3"}, Telecom: []dstu3.ContactPoint{{System: "phone", Use: "home", Value: "555-0100"}}},
+	}
+	for _, resource := range resources {
+		if _, err := store.Update(resource, ""); err != nil {
+			t.Fatalf("store update failed: %v", err)
+		}
+	}
+	definition := &dstu3.SearchParameter{
+		ResourceBase: dstu3.ResourceBase{ResourceType: "SearchParameter", ID: "eye-colour"},
+		URL:          "http://example.org/fhir/SearchParameter/eye-colour",
+		Code:         "eye-colour",
+		Base:         []string{"Patient"},
+		Type:         "token",
+		Expression:   "Patient.extension('http://example.org/fhir/eye-colour').value as code",
+	}
+	if err := searcher.CheckSearchParameter(definition); err != nil {
+		t.Fatalf("expected the parameter to be accepted: %v", err)
+	}
+	if _, err := store.Update(definition, ""); err != nil {
+		t.Fatalf("store update failed: %v", err)
+	}
+	expectIDs(t, searcher, "Patient", "eye-colour=green", []string{"pat-2"})
+	expectIDs(t, searcher, "Patient", "eye-colour:missing=true", []string{"pat-3"})
+
+	definition.Code = "work-phone"
+	definition.Type = "string"
+	definition.Expression = "(Patient.telecom.where(use = 'work').value)"
+	if _, err := store.Update(definition, ""); err != nil {
+		t.Fatalf("store update failed: %v", err)
+	}
+	expectIDs(t, searcher, "Patient", "work-phone=555", []string{"pat-2"})
+	if _, err := searcher.Search("Patient", url.Values{"eye-colour": {"green"}}); err == nil {
+		t.Fatalf("expected the replaced code to be unknown")
+	}
+	if err := store.Delete("SearchParameter", "eye-colour", ""); err != nil {
+		t.Fatalf("store delete failed: %v", err)
+	}
+	if _, err := searcher.Search("Patient", url.Values{"work-phone": {"555"}}); err == nil {
+		t.Fatalf("expected a deleted parameter to be unknown")
+	}
+
+	for _, invalid := range []dstu3.SearchParameter{
+		{Code: "family", Base: []string{"Patient"}, Type: "string", Expression: "Patient.name.family"},
+		{Code: "colour", Base: []string{"Patient"}, Type: "token", Expression: "Patient.extension.first()"},
+		{Code: "colour", Base: []string{"Patient"}, Type: "token", Expression: "Practitioner.gender"},
+		{Code: "colour", Base: []string{"Patient"}, Type: "composite", Expression: "Patient.gender"},
+	} {
+		invalid.ResourceType = "SearchParameter"
+		if err := searcher.CheckSearchParameter(&invalid); err == nil {
+			t.Fatalf("expected %s %q to be rejected", invalid.Code, invalid.Expression)
+		}
+	}
+}
+
+func TestPagedIncludesAreComputedPerPage(t *testing.T) {
+	registry := dstu3.NewRegistry()
+	store := store.NewMemoryStore()
+	searcher := NewSearcher(registry, store)
+
+	resources := []dstu3.Resource{
+		&dstu3.Organization{ResourceBase: dstu3.ResourceBase{ResourceType: "Organization", ID: "org-1"}},
+		&dstu3.Organization{ResourceBase: dstu3.ResourceBase{ResourceType: "Organization", ID: "org-2"}},
+		&dstu3.Patient{ResourceBase: dstu3.ResourceBase{ResourceType: "Patient", ID: "pat-1"}, ManagingOrganization: &dstu3.Reference{Reference: "Organization/org-1"}},
+		&dstu3.Patient{ResourceBase: dstu3.ResourceBase{ResourceType: "Patient", ID: "pat-2"}, ManagingOrganization: &dstu3.Reference{Reference: "Organization/org-2"}},
+	}
+	for _, resource := range resources {
+		if _, err := store.Update(resource, ""); err != nil {
+			t.Fatalf("store update failed: %v", err)
+		}
+	}
+
+	query := url.Values{"_include": {"Patient:organization"}, "_count": {"1"}}
+	first, err := searcher.Search("Patient", query)
+	if err != nil {
+		t.Fatalf("search failed: %v", err)
+	}
+	if first.IncludeDepth != DefaultIncludeDepth || len(first.Included) != 1 || first.Included[0].Resource.GetID() != "org-1" {
+		t.Fatalf("unexpected first page: depth %d, %d included", first.IncludeDepth, len(first.Included))
+	}
+	snapshot, _ := searcher.pages.get(first.Token)
+	if len(snapshot.includes) != 1 {
+		t.Fatalf("expected only the served page's includes, got %d pages", len(snapshot.includes))
+	}
+
+	second, err := searcher.Search("Patient", url.Values{PagesParam: {first.Token}, PagesOffsetParam: {"1"}})
+	if err != nil {
+		t.Fatalf("page failed: %v", err)
+	}
+	if second.IncludeDepth != DefaultIncludeDepth || len(second.Included) != 1 || second.Included[0].Resource.GetID() != "org-2" {
+		t.Fatalf("unexpected second page: depth %d, %d included", second.IncludeDepth, len(second.Included))
+	}
+}
+
+func TestSystemSortResolvesPerType(t *testing.T) {
+	registry := dstu3.NewRegistry()
+	store := store.NewMemoryStore()
+	searcher := NewSearcher(registry, store)
+
+	resources := []dstu3.Resource{
+		&dstu3.Patient{ResourceBase: dstu3.ResourceBase{ResourceType: "Patient", ID: "pat-1"}, Name: []dstu3.HumanName{{Family: []string{"Young"}}}},
+		&dstu3.Patient{ResourceBase: dstu3.ResourceBase{ResourceType: "Patient", ID: "pat-2"}, Name: []dstu3.HumanName{{Family: []string{"Adams"}}}},
+		&dstu3.Flag{ResourceBase: dstu3.ResourceBase{ResourceType: "Flag", ID: "flag-1"}, Status: "active"},
+		&dstu3.Organization{ResourceBase: dstu3.ResourceBase{ResourceType: "Organization", ID: "org-1"}, Name: "Midland"},
+	}
+	for _, resource := range resources {
+		if _, err := store.Update(resource, ""); err != nil {
+			t.Fatalf("store update failed: %v", err)
+		}
+	}
+
+	search := func(rawQuery string) (string, error) {
+		query, _ := url.ParseQuery(rawQuery)
+		result, err := searcher.SearchSystem(query)
+		if err != nil {
+			return "", err
+		}
+		keys := []string{}
+		for _, entry := range result.Entries {
+			keys = append(keys, entryKey(entry))
+		}
+		return strings.Join(keys, ","), nil
+	}
+	if keys, err := search("_type=Patient,Flag,Organization&_sort=name"); err != nil || keys != "Patient/pat-2,Organization/org-1,Patient/pat-1,Flag/flag-1" {
+		t.Fatalf("expected name order with Flag last, got %q (%v)", keys, err)
+	}
+	if keys, err := search("_type=Patient,Flag&_sort=-family"); err != nil || keys != "Patient/pat-1,Patient/pat-2,Flag/flag-1" {
+		t.Fatalf("expected family order with Flag last, got %q (%v)", keys, err)
+	}
+	if _, err := search("_type=Patient,Flag&_sort=unicorn"); err == nil {
+		t.Fatalf("expected an error for a parameter no type defines")
+	}
+}
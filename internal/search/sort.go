@@ -0,0 +1,205 @@
+package search
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"mini-fhir/internal/store"
+)
+
+// sortField is one _sort parameter. param is the zero value when the
+// resource type does not define code.
+type sortField struct {
+	code  string
+	param SearchParam
+	desc  bool
+}
+
+// sortKey is the value an entry sorts on for one field. Entries without a
+// value sort last in either direction.
+type sortKey struct {
+	present   bool
+	paramType ParamType
+	text      string
+	number    float64
+	dates     dateRange
+}
+
+// sortEntries orders entries by each _sort field in turn, breaking ties on
+// resource type and id so results are deterministic. Fields are resolved
+// per resource type: entries whose type does not define a parameter sort
+// as missing values, and a parameter no searched type defines is an error.
+func (s *Searcher) sortEntries(resourceTypes []string, entries []*store.ResourceEntry, sortParam string) ([]*store.ResourceEntry, error) {
+	if len(resourceTypes) == 0 {
+		return entries, nil
+	}
+	fieldsByType := map[string][]sortField{}
+	for _, resourceType := range resourceTypes {
+		fieldsByType[resourceType] = s.parseSort(resourceType, sortParam)
+	}
+	fields := fieldsByType[resourceTypes[0]]
+	if len(fields) == 0 {
+		return entries, nil
+	}
+	for i, field := range fields {
+		defined := false
+		for _, resourceType := range resourceTypes {
+			defined = defined || fieldsByType[resourceType][i].param.Code != ""
+		}
+		if !defined {
+			return nil, fmt.Errorf("unknown _sort parameter %q for %s", field.code, strings.Join(resourceTypes, ","))
+		}
+	}
+
+	keys := make(map[*store.ResourceEntry][]sortKey, len(entries))
+	for _, entry := range entries {
+		tree := resourceTree(entry.Resource)
+		entryFields := fieldsByType[entry.Resource.GetResourceType()]
+		entryKeys := make([]sortKey, len(entryFields))
+		for i, field := range entryFields {
+			entryKeys[i] = fieldKey(tree, field)
+		}
+		keys[entry] = entryKeys
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		left, right := keys[entries[i]], keys[entries[j]]
+		for k, field := range fields {
+			if c := compareKeys(field, left[k], right[k]); c != 0 {
+				return c < 0
+			}
+		}
+		return entryKey(entries[i]) < entryKey(entries[j])
+	})
+	return entries, nil
+}
+
+// sortAliases keeps the _sort keys accepted before _sort took search
+// parameter codes.
+var sortAliases = map[string]string{"id": "_id"}
+
+func (s *Searcher) parseSort(resourceType, sortParam string) []sortField {
+	fields := []sortField{}
+	for _, raw := range strings.Split(sortParam, ",") {
+		code := strings.TrimSpace(raw)
+		if code == "" {
+			continue
+		}
+		field := sortField{}
+		if strings.HasPrefix(code, "-") {
+			field.desc = true
+			code = code[1:]
+		}
+		field.code = code
+		field.param = s.paramTable()[resourceType][code]
+		if alias, ok := sortAliases[code]; ok && field.param.Code == "" {
+			field.param = s.paramTable()[resourceType][alias]
+		}
+		fields = append(fields, field)
+	}
+	return fields
+}
+
+// fieldKey picks the value an entry sorts on: the lowest of its values
+// when ascending and the highest when descending. Paths are tried in
+// order, so later paths only apply when earlier ones are empty.
+func fieldKey(tree map[string]any, field sortField) sortKey {
+	var best sortKey
+	for _, path := range field.param.Paths {
+		for _, node := range extract(tree, []string{path}) {
+			for _, key := range nodeKeys(field.param.Type, node) {
+				if !best.present || compareValues(field.param.Type, key, best, field.desc) < 0 {
+					best = key
+				}
+			}
+		}
+		if best.present {
+			break
+		}
+	}
+	return best
+}
+
+func nodeKeys(paramType ParamType, node any) []sortKey {
+	out := []sortKey{}
+	switch paramType {
+	case ParamDate:
+		if dates, ok := targetDateRange(node); ok {
+			out = append(out, sortKey{present: true, paramType: paramType, dates: dates})
+		}
+	case ParamNumber, ParamQuantity:
+		if object, ok := node.(map[string]any); ok {
+			node = object["value"]
+		}
+		if number, ok := node.(float64); ok {
+			out = append(out, sortKey{present: true, paramType: paramType, number: number})
+		}
+	case ParamToken:
+		for _, token := range tokenValues(node) {
+			out = append(out, sortKey{present: true, paramType: paramType, text: token.code})
+		}
+	case ParamReference:
+		if object, ok := node.(map[string]any); ok {
+			if reference, ok := object["reference"].(string); ok {
+				out = append(out, sortKey{present: true, paramType: paramType, text: reference})
+			}
+		}
+	default:
+		for _, text := range stringLeaves(node) {
+			out = append(out, sortKey{present: true, paramType: paramType, text: strings.ToLower(text)})
+		}
+	}
+	return out
+}
+
+func compareKeys(field sortField, left, right sortKey) int {
+	switch {
+	case !left.present && !right.present:
+		return 0
+	case !left.present:
+		return 1
+	case !right.present:
+		return -1
+	case left.paramType != right.paramType:
+		// Types may define the same code with different parameter types;
+		// group the values by type so the order stays consistent.
+		return strings.Compare(string(left.paramType), string(right.paramType))
+	}
+	return compareValues(left.paramType, left, right, field.desc)
+}
+
+// compareValues orders two present keys in the requested direction. Dates
+// compare by the instant range they cover, so "1980" sorts before
+// "1980-05-17" ascending and after it descending.
+func compareValues(paramType ParamType, left, right sortKey, desc bool) int {
+	c := 0
+	switch paramType {
+	case ParamDate:
+		if desc {
+			c = right.dates.end.Compare(left.dates.end)
+			if c == 0 {
+				c = right.dates.start.Compare(left.dates.start)
+			}
+			return c
+		}
+		c = left.dates.start.Compare(right.dates.start)
+		if c == 0 {
+			c = left.dates.end.Compare(right.dates.end)
+		}
+		return c
+	case ParamNumber, ParamQuantity:
+		switch {
+		case left.number < right.number:
+			c = -1
+		case left.number > right.number:
+			c = 1
+		}
+	default:
+		c = strings.Compare(left.text, right.text)
+	}
+	if desc {
+		return -c
+	}
+	return c
+}
@@ -0,0 +1,103 @@
+package store
+
+import (
+	"sync"
+	"time"
+)
+
+// timestampLayout is fixed-width so lastUpdated values also sort as strings.
+const timestampLayout = "2006-01-02T15:04:05.000000Z07:00"
+
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+// AdjustableClock follows the system clock by default and can be frozen,
+// set or advanced so tests control the timestamps the store assigns.
+type AdjustableClock struct {
+	mu     sync.Mutex
+	frozen bool
+	at     time.Time
+	offset time.Duration
+}
+
+type ClockState struct {
+	Now    string `json:"now"`
+	Frozen bool   `json:"frozen"`
+}
+
+func NewAdjustableClock() *AdjustableClock {
+	return &AdjustableClock{}
+}
+
+func (c *AdjustableClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.now()
+}
+
+// Freeze stops the clock at at, or at the current time when at is zero.
+func (c *AdjustableClock) Freeze(at time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if at.IsZero() {
+		at = c.now()
+	}
+	c.frozen = true
+	c.at = at
+}
+
+// Set moves the clock to at without changing whether it is frozen.
+func (c *AdjustableClock) Set(at time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.frozen {
+		c.at = at
+		return
+	}
+	c.offset = time.Until(at)
+}
+
+func (c *AdjustableClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.frozen {
+		c.at = c.at.Add(d)
+		return
+	}
+	c.offset += d
+}
+
+// Resume lets a frozen clock run again from the instant it was frozen at.
+func (c *AdjustableClock) Resume() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.frozen {
+		return
+	}
+	c.offset = time.Until(c.at)
+	c.frozen = false
+}
+
+func (c *AdjustableClock) State() ClockState {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return ClockState{Now: c.now().UTC().Format(timestampLayout), Frozen: c.frozen}
+}
+
+func (c *AdjustableClock) now() time.Time {
+	if c.frozen {
+		return c.at
+	}
+	return time.Now().Add(c.offset)
+}
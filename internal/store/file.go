@@ -0,0 +1,356 @@
+package store
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"mini-fhir/internal/fhir/dstu3"
+)
+
+const (
+	logFileName      = "store.log"
+	snapshotFileName = "store.snapshot.json"
+
+	DefaultSnapshotEvery = 1000
+)
+
+// FileStore keeps the working set in a MemoryStore and persists every
+// mutation to an append-only log, compacting it into a snapshot every
+// snapshotEvery writes.
+type FileStore struct {
+	mu            sync.Mutex
+	mem           *MemoryStore
+	registry      *dstu3.Registry
+	dir           string
+	log           *os.File
+	pending       int
+	snapshotEvery int
+	// sequence numbers log records. The snapshot stores the last one it
+	// covers so replay skips records already folded into it.
+	sequence uint64
+}
+
+type logRecord struct {
+	Seq          uint64          `json:"seq,omitempty"`
+	Op           string          `json:"op"`
+	ResourceType string          `json:"resourceType"`
+	ID           string          `json:"id"`
+	VersionID    string          `json:"versionId,omitempty"`
+	LastUpdated  string          `json:"lastUpdated,omitempty"`
+	Method       string          `json:"method,omitempty"`
+	Resource     json.RawMessage `json:"resource,omitempty"`
+}
+
+func OpenFileStore(dir string, registry *dstu3.Registry, snapshotEvery int) (*FileStore, error) {
+	if dir == "" {
+		return nil, fmt.Errorf("store directory is required")
+	}
+	if snapshotEvery <= 0 {
+		snapshotEvery = DefaultSnapshotEvery
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	fs := &FileStore{
+		mem:           NewMemoryStore(),
+		registry:      registry,
+		dir:           dir,
+		snapshotEvery: snapshotEvery,
+	}
+	if err := fs.loadSnapshot(); err != nil {
+		return nil, fmt.Errorf("load snapshot: %w", err)
+	}
+	if err := fs.replayLog(); err != nil {
+		return nil, fmt.Errorf("replay log: %w", err)
+	}
+	logFile, err := os.OpenFile(filepath.Join(dir, logFileName), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	fs.log = logFile
+	return fs, nil
+}
+
+func (f *FileStore) SetClock(clock Clock) {
+	f.mem.SetClock(clock)
+}
+
+// Create, Update and Delete apply a write in memory and then log it. When
+// the log append fails the memory change is undone, so memory never holds
+// a write the log does not.
+func (f *FileStore) Create(resource dstu3.Resource) (*ResourceEntry, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	previous := f.previous(resource)
+	entry, err := f.mem.Create(resource)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.appendPut(entry); err != nil {
+		f.mem.setEntry(resource.GetResourceType(), resource.GetID(), previous)
+		return nil, err
+	}
+	return entry, nil
+}
+
+func (f *FileStore) Update(resource dstu3.Resource, expectedVersion string) (*ResourceEntry, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	previous := f.previous(resource)
+	entry, err := f.mem.Update(resource, expectedVersion)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.appendPut(entry); err != nil {
+		f.mem.setEntry(resource.GetResourceType(), resource.GetID(), previous)
+		return nil, err
+	}
+	return entry, nil
+}
+
+func (f *FileStore) Delete(resourceType, id, expectedVersion string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	previous := f.mem.entry(resourceType, id)
+	tombstone, err := f.mem.delete(resourceType, id, expectedVersion)
+	if err != nil || tombstone == nil {
+		return err
+	}
+	err = f.append(logRecord{
+		Op:           "delete",
+		ResourceType: resourceType,
+		ID:           id,
+		VersionID:    tombstone.VersionID,
+		LastUpdated:  tombstone.LastUpdated,
+		Method:       tombstone.Method,
+	})
+	if err != nil {
+		f.mem.setEntry(resourceType, id, previous)
+	}
+	return err
+}
+
+func (f *FileStore) previous(resource dstu3.Resource) *ResourceEntry {
+	if resource == nil {
+		return nil
+	}
+	return f.mem.entry(resource.GetResourceType(), resource.GetID())
+}
+
+func (f *FileStore) Get(resourceType, id string) (*ResourceEntry, error) {
+	return f.mem.Get(resourceType, id)
+}
+
+func (f *FileStore) List(resourceType string) ([]*ResourceEntry, error) {
+	return f.mem.List(resourceType)
+}
+
+func (f *FileStore) History(resourceType, id string) ([]*ResourceVersion, error) {
+	return f.mem.History(resourceType, id)
+}
+
+func (f *FileStore) Version(resourceType, id, versionID string) (*ResourceVersion, error) {
+	return f.mem.Version(resourceType, id, versionID)
+}
+
+func (f *FileStore) TypeHistory(resourceType string) []*ResourceVersion {
+	return f.mem.TypeHistory(resourceType)
+}
+
+func (f *FileStore) SystemHistory() []*ResourceVersion {
+	return f.mem.SystemHistory()
+}
+
+func (f *FileStore) Dump() *State {
+	return f.mem.Dump()
+}
+
+// Restore replaces the store contents and compacts the log so the
+// restored state is what survives a restart. The snapshot is written
+// before memory is swapped, so a failed write leaves both unchanged.
+func (f *FileStore) Restore(state *State) error {
+	if state == nil {
+		return fmt.Errorf("state is nil")
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.saveSnapshot(state); err != nil {
+		return err
+	}
+	return f.mem.Restore(state)
+}
+
+// Compact writes the full store state and truncates the log.
+func (f *FileStore) Compact() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.writeSnapshot()
+}
+
+func (f *FileStore) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.log == nil {
+		return nil
+	}
+	err := f.writeSnapshot()
+	if closeErr := f.log.Close(); err == nil {
+		err = closeErr
+	}
+	f.log = nil
+	return err
+}
+
+func (f *FileStore) appendPut(entry *ResourceEntry) error {
+	data, err := json.Marshal(entry.Resource)
+	if err != nil {
+		return err
+	}
+	return f.append(logRecord{
+		Op:           "put",
+		ResourceType: entry.Resource.GetResourceType(),
+		ID:           entry.Resource.GetID(),
+		VersionID:    entry.VersionID,
+		LastUpdated:  entry.LastUpdated,
+		Method:       entry.Method,
+		Resource:     data,
+	})
+}
+
+// append writes record durably to the log. A failed write is cut back
+// off the log so a partial line never reaches replay.
+func (f *FileStore) append(record logRecord) error {
+	if f.log == nil {
+		return fmt.Errorf("store is closed")
+	}
+	record.Seq = f.sequence + 1
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	info, err := f.log.Stat()
+	if err != nil {
+		return err
+	}
+	if _, err := f.log.Write(append(data, '\n')); err != nil {
+		f.log.Truncate(info.Size())
+		return err
+	}
+	if err := f.log.Sync(); err != nil {
+		f.log.Truncate(info.Size())
+		return err
+	}
+	f.sequence = record.Seq
+	f.pending++
+	if f.pending >= f.snapshotEvery {
+		// The record is already durable; a failed compaction is retried
+		// on the next write.
+		f.writeSnapshot()
+	}
+	return nil
+}
+
+func (f *FileStore) writeSnapshot() error {
+	return f.saveSnapshot(f.mem.Dump())
+}
+
+// saveSnapshot writes state as the snapshot covering every logged record
+// and truncates the log. Once the snapshot is written it is what a
+// restart loads, even if the truncate fails.
+func (f *FileStore) saveSnapshot(state *State) error {
+	snapshot := &State{resources: state.resources, sequence: f.sequence}
+	if err := writeStateFile(filepath.Join(f.dir, snapshotFileName), snapshot); err != nil {
+		return err
+	}
+	f.pending = 0
+	if f.log != nil {
+		f.log.Truncate(0)
+	}
+	return nil
+}
+
+func (f *FileStore) loadSnapshot() error {
+	data, err := os.ReadFile(filepath.Join(f.dir, snapshotFileName))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	state, err := DecodeState(data, f.registry)
+	if err != nil {
+		return err
+	}
+	f.sequence = state.sequence
+	return f.mem.Restore(state)
+}
+
+func (f *FileStore) replayLog() error {
+	file, err := os.Open(filepath.Join(f.dir, logFileName))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 64*1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var record logRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+		// A crash between writing a snapshot and truncating the log leaves
+		// records the snapshot already holds.
+		if record.Seq != 0 && record.Seq <= f.sequence {
+			continue
+		}
+		switch record.Op {
+		case "put":
+			resource, err := f.registry.DecodeResource(record.Resource)
+			if err != nil {
+				return fmt.Errorf("line %d: %w", line, err)
+			}
+			f.mem.putVersion(&ResourceVersion{
+				ResourceType: record.ResourceType,
+				ID:           record.ID,
+				VersionID:    record.VersionID,
+				LastUpdated:  record.LastUpdated,
+				Method:       record.Method,
+				Resource:     resource,
+			})
+		case "delete":
+			f.mem.putVersion(&ResourceVersion{
+				ResourceType: record.ResourceType,
+				ID:           record.ID,
+				VersionID:    record.VersionID,
+				LastUpdated:  record.LastUpdated,
+				Deleted:      true,
+				Method:       record.Method,
+			})
+		default:
+			return fmt.Errorf("line %d: unknown op %q", line, record.Op)
+		}
+		f.sequence = max(f.sequence, record.Seq)
+		f.pending++
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,134 @@
+package store
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"mini-fhir/internal/fhir/dstu3"
+)
+
+func TestFileStorePersistsAcrossRestart(t *testing.T) {
+	registry := dstu3.NewRegistry()
+	dir := t.TempDir()
+
+	first, err := OpenFileStore(dir, registry, 2)
+	if err != nil {
+		t.Fatalf("open failed: %v", err)
+	}
+	for _, id := range []string{"pat-1", "pat-2", "pat-1"} {
+		patient := &dstu3.Patient{ResourceBase: dstu3.ResourceBase{ResourceType: "Patient", ID: id}, Gender: "female"}
+		if _, err := first.Update(patient, ""); err != nil {
+			t.Fatalf("update failed: %v", err)
+		}
+	}
+	if err := first.Delete("Patient", "pat-2", ""); err != nil {
+		t.Fatalf("delete failed: %v", err)
+	}
+	before, err := first.Get("Patient", "pat-1")
+	if err != nil {
+		t.Fatalf("get failed: %v", err)
+	}
+	// Simulate a crash: the delete is only in the log, not the snapshot.
+	first.log.Close()
+
+	second, err := OpenFileStore(dir, registry, 2)
+	if err != nil {
+		t.Fatalf("reopen failed: %v", err)
+	}
+	defer second.Close()
+	after, err := second.Get("Patient", "pat-1")
+	if err != nil {
+		t.Fatalf("get after reopen failed: %v", err)
+	}
+	if after.VersionID != "2" || after.LastUpdated != before.LastUpdated || len(after.History) != 1 {
+		t.Fatalf("unexpected entry after reopen: %+v", after)
+	}
+	if _, err := second.Get("Patient", "pat-2"); err == nil {
+		t.Fatalf("expected pat-2 to stay deleted")
+	}
+	if versions, err := second.History("Patient", "pat-2"); err != nil || versions[0].Method != MethodDelete || versions[1].Method != MethodUpdate {
+		t.Fatalf("expected methods to survive reopen, got %+v (%v)", versions, err)
+	}
+	entries, err := second.List("Patient")
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("expected 1 patient, got %d (%v)", len(entries), err)
+	}
+}
+
+func TestFileStoreReplayIsIdempotent(t *testing.T) {
+	registry := dstu3.NewRegistry()
+	dir := t.TempDir()
+
+	first, err := OpenFileStore(dir, registry, 100)
+	if err != nil {
+		t.Fatalf("open failed: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		patient := &dstu3.Patient{ResourceBase: dstu3.ResourceBase{ResourceType: "Patient", ID: "pat-1"}}
+		if _, err := first.Update(patient, ""); err != nil {
+			t.Fatalf("update failed: %v", err)
+		}
+	}
+	logged, err := os.ReadFile(filepath.Join(dir, logFileName))
+	if err != nil {
+		t.Fatalf("read log failed: %v", err)
+	}
+	// Simulate a crash after the snapshot rename but before the truncate.
+	if err := first.Close(); err != nil {
+		t.Fatalf("close failed: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, logFileName), logged, 0o644); err != nil {
+		t.Fatalf("restore log failed: %v", err)
+	}
+
+	second, err := OpenFileStore(dir, registry, 100)
+	if err != nil {
+		t.Fatalf("reopen failed: %v", err)
+	}
+	history, err := second.History("Patient", "pat-1")
+	if err != nil || len(history) != 2 || history[0].VersionID != "2" || history[1].VersionID != "1" {
+		t.Fatalf("expected versions 2,1 once, got %d versions (%v)", len(history), err)
+	}
+
+	// A write whose log append fails must not stay in memory.
+	second.log.Close()
+	patient := &dstu3.Patient{ResourceBase: dstu3.ResourceBase{ResourceType: "Patient", ID: "pat-2"}}
+	if _, err := second.Create(patient); err == nil {
+		t.Fatalf("expected create to fail with a closed log")
+	}
+	if _, err := second.Get("Patient", "pat-2"); err != ErrNotFound {
+		t.Fatalf("expected the failed create to be undone, got %v", err)
+	}
+	if err := second.Delete("Patient", "pat-1", ""); err == nil {
+		t.Fatalf("expected delete to fail with a closed log")
+	}
+	if entry, err := second.Get("Patient", "pat-1"); err != nil || entry.VersionID != "2" {
+		t.Fatalf("expected the failed delete to be undone, got %v", err)
+	}
+}
+
+func TestFileStoreRestoreKeepsStateWhenSnapshotFails(t *testing.T) {
+	registry := dstu3.NewRegistry()
+	dir := t.TempDir()
+
+	store, err := OpenFileStore(dir, registry, 100)
+	if err != nil {
+		t.Fatalf("open failed: %v", err)
+	}
+	defer store.Close()
+	patient := &dstu3.Patient{ResourceBase: dstu3.ResourceBase{ResourceType: "Patient", ID: "pat-1"}}
+	if _, err := store.Create(patient); err != nil {
+		t.Fatalf("create failed: %v", err)
+	}
+	// A directory in the way of the temporary file makes the write fail.
+	if err := os.Mkdir(filepath.Join(dir, snapshotFileName+".tmp"), 0o755); err != nil {
+		t.Fatalf("mkdir failed: %v", err)
+	}
+	if err := store.Restore(NewMemoryStore().Dump()); err == nil {
+		t.Fatalf("expected restore to fail")
+	}
+	if _, err := store.Get("Patient", "pat-1"); err != nil {
+		t.Fatalf("expected a failed restore to leave the store unchanged, got %v", err)
+	}
+}
@@ -0,0 +1,74 @@
+package store
+
+import (
+	"crypto/rand"
+	"fmt"
+	"strconv"
+	"sync"
+)
+
+// IDGenerator returns a new logical id for a resource of the given type.
+type IDGenerator func(resourceType string) string
+
+func UUIDGenerator() IDGenerator {
+	return func(string) string {
+		var b [16]byte
+		if _, err := rand.Read(b[:]); err != nil {
+			panic(fmt.Sprintf("uuid: %v", err))
+		}
+		b[6] = (b[6] & 0x0f) | 0x40
+		b[8] = (b[8] & 0x3f) | 0x80
+		return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+	}
+}
+
+// Sequence numbers resources 1, 2, 3... per resource type so CI runs get
+// reproducible ids. Each counter starts after the highest numeric id the
+// store holds for its type, deleted ones included, so ids are never reused
+// across restarts or seeding.
+type Sequence struct {
+	mu       sync.Mutex
+	store    Store
+	counters map[string]int
+}
+
+func NewSequence(store Store) *Sequence {
+	return &Sequence{store: store, counters: map[string]int{}}
+}
+
+// Next returns the next id for resourceType. It is an IDGenerator.
+func (q *Sequence) Next(resourceType string) string {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if _, ok := q.counters[resourceType]; !ok {
+		q.counters[resourceType] = highestNumericID(q.store, resourceType)
+	}
+	q.counters[resourceType]++
+	return strconv.Itoa(q.counters[resourceType])
+}
+
+func highestNumericID(store Store, resourceType string) int {
+	highest := 0
+	for _, version := range store.TypeHistory(resourceType) {
+		if n, err := strconv.Atoi(version.ID); err == nil && n > highest {
+			highest = n
+		}
+	}
+	return highest
+}
+
+// Restore runs restore, which replaces the store contents, and then drops
+// the counters so each is seeded from the restored store on next use. Both
+// happen under the sequence lock, so Next cannot hand out an id from a
+// counter seeded in between.
+func (q *Sequence) Restore(restore func() error) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if err := restore(); err != nil {
+		return err
+	}
+	q.counters = map[string]int{}
+	return nil
+}
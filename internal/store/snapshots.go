@@ -0,0 +1,162 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"mini-fhir/internal/fhir/dstu3"
+)
+
+var (
+	ErrSnapshotNotFound = errors.New("snapshot not found")
+
+	snapshotNamePattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+)
+
+const snapshotSuffix = ".snapshot.json"
+
+type SnapshotInfo struct {
+	Name      string `json:"name"`
+	Storage   string `json:"storage"`
+	Resources int    `json:"resources,omitempty"`
+}
+
+// Snapshots captures and restores named copies of a store, either in
+// memory or as files under dir.
+type Snapshots struct {
+	mu       sync.Mutex
+	store    Store
+	registry *dstu3.Registry
+	dir      string
+	memory   map[string]*State
+}
+
+func NewSnapshots(store Store, registry *dstu3.Registry, dir string) *Snapshots {
+	return &Snapshots{store: store, registry: registry, dir: dir, memory: map[string]*State{}}
+}
+
+func (s *Snapshots) Save(name string, onDisk bool) (*SnapshotInfo, error) {
+	if !snapshotNamePattern.MatchString(name) {
+		return nil, fmt.Errorf("invalid snapshot name: %q", name)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	state := s.store.Dump()
+	if !onDisk {
+		s.memory[name] = state
+		return &SnapshotInfo{Name: name, Storage: "memory", Resources: state.Len()}, nil
+	}
+	if s.dir == "" {
+		return nil, fmt.Errorf("on-disk snapshots are not configured")
+	}
+	if err := os.MkdirAll(s.dir, 0o755); err != nil {
+		return nil, err
+	}
+	if err := writeStateFile(s.path(name), state); err != nil {
+		return nil, err
+	}
+	return &SnapshotInfo{Name: name, Storage: "disk", Resources: state.Len()}, nil
+}
+
+// Restore replaces the store contents with the named snapshot. In-memory
+// snapshots take precedence over on-disk ones with the same name.
+func (s *Snapshots) Restore(name string) (*SnapshotInfo, error) {
+	if !snapshotNamePattern.MatchString(name) {
+		return nil, fmt.Errorf("invalid snapshot name: %q", name)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	info := &SnapshotInfo{Name: name, Storage: "memory"}
+	state, ok := s.memory[name]
+	if !ok {
+		loaded, err := s.load(name)
+		if err != nil {
+			return nil, err
+		}
+		state = loaded
+		info.Storage = "disk"
+	}
+	if err := s.store.Restore(state); err != nil {
+		return nil, err
+	}
+	info.Resources = state.Len()
+	return info, nil
+}
+
+func (s *Snapshots) Delete(name string) error {
+	if !snapshotNamePattern.MatchString(name) {
+		return fmt.Errorf("invalid snapshot name: %q", name)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, found := s.memory[name]
+	delete(s.memory, name)
+	if s.dir != "" {
+		err := os.Remove(s.path(name))
+		if err == nil {
+			found = true
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	if !found {
+		return ErrSnapshotNotFound
+	}
+	return nil
+}
+
+func (s *Snapshots) List() ([]SnapshotInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	out := make([]SnapshotInfo, 0, len(s.memory))
+	for name, state := range s.memory {
+		out = append(out, SnapshotInfo{Name: name, Storage: "memory", Resources: state.Len()})
+	}
+	if s.dir != "" {
+		files, err := os.ReadDir(s.dir)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+		for _, file := range files {
+			if file.IsDir() || !strings.HasSuffix(file.Name(), snapshotSuffix) {
+				continue
+			}
+			out = append(out, SnapshotInfo{Name: strings.TrimSuffix(file.Name(), snapshotSuffix), Storage: "disk"})
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Name != out[j].Name {
+			return out[i].Name < out[j].Name
+		}
+		return out[i].Storage < out[j].Storage
+	})
+	return out, nil
+}
+
+func (s *Snapshots) load(name string) (*State, error) {
+	if s.dir == "" {
+		return nil, ErrSnapshotNotFound
+	}
+	data, err := os.ReadFile(s.path(name))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrSnapshotNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return DecodeState(data, s.registry)
+}
+
+func (s *Snapshots) path(name string) string {
+	return filepath.Join(s.dir, name+snapshotSuffix)
+}
@@ -0,0 +1,74 @@
+package store
+
+import (
+	"testing"
+	"time"
+
+	"mini-fhir/internal/fhir/dstu3"
+)
+
+func TestSnapshotsDiskRoundTrip(t *testing.T) {
+	registry := dstu3.NewRegistry()
+	mem := NewMemoryStore()
+	snapshots := NewSnapshots(mem, registry, t.TempDir())
+
+	patient := &dstu3.Patient{ResourceBase: dstu3.ResourceBase{ResourceType: "Patient", ID: "pat-1"}}
+	if _, err := mem.Update(patient, ""); err != nil {
+		t.Fatalf("update failed: %v", err)
+	}
+	if err := mem.Delete("Patient", "pat-1", ""); err != nil {
+		t.Fatalf("delete failed: %v", err)
+	}
+	if _, err := snapshots.Save("deleted", true); err != nil {
+		t.Fatalf("save failed: %v", err)
+	}
+	if _, err := mem.Update(patient, ""); err != nil {
+		t.Fatalf("update failed: %v", err)
+	}
+
+	restored := NewMemoryStore()
+	info, err := NewSnapshots(restored, registry, snapshots.dir).Restore("deleted")
+	if err != nil {
+		t.Fatalf("restore failed: %v", err)
+	}
+	if info.Storage != "disk" {
+		t.Fatalf("expected disk snapshot, got %s", info.Storage)
+	}
+	history, err := restored.History("Patient", "pat-1")
+	if err != nil {
+		t.Fatalf("history failed: %v", err)
+	}
+	if len(history) != 2 || !history[0].Deleted || history[0].VersionID != "2" {
+		t.Fatalf("unexpected restored history: %+v", history)
+	}
+	if _, err := snapshots.Save("../escape", true); err == nil {
+		t.Fatalf("expected invalid name to be rejected")
+	}
+}
+
+func TestSequenceRestoreHoldsNext(t *testing.T) {
+	mem := NewMemoryStore()
+	fixture := mem.Dump()
+	for _, id := range []string{"1", "2", "3"} {
+		if _, err := mem.Update(&dstu3.Patient{ResourceBase: dstu3.ResourceBase{ResourceType: "Patient", ID: id}}, ""); err != nil {
+			t.Fatalf("update failed: %v", err)
+		}
+	}
+	sequence := NewSequence(mem)
+	if id := sequence.Next("Patient"); id != "4" {
+		t.Fatalf("expected 4, got %s", id)
+	}
+
+	ids := make(chan string)
+	err := sequence.Restore(func() error {
+		go func() { ids <- sequence.Next("Patient") }()
+		time.Sleep(10 * time.Millisecond)
+		return mem.Restore(fixture)
+	})
+	if err != nil {
+		t.Fatalf("restore failed: %v", err)
+	}
+	if id := <-ids; id != "1" {
+		t.Fatalf("expected an id seeded from the restored store, got %s", id)
+	}
+}
@@ -0,0 +1,185 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"mini-fhir/internal/fhir/dstu3"
+)
+
+// State is a deep copy of every entry in a store, including histories and
+// tombstones, as captured by Dump. A FileStore snapshot also records the
+// last log sequence it covers.
+type State struct {
+	resources map[string]map[string]*ResourceEntry
+	sequence  uint64
+}
+
+func (st *State) Len() int {
+	count := 0
+	for _, items := range st.resources {
+		count += len(items)
+	}
+	return count
+}
+
+func cloneResources(resources map[string]map[string]*ResourceEntry) map[string]map[string]*ResourceEntry {
+	out := make(map[string]map[string]*ResourceEntry, len(resources))
+	for resourceType, items := range resources {
+		out[resourceType] = make(map[string]*ResourceEntry, len(items))
+		for id, entry := range items {
+			out[resourceType][id] = cloneEntry(entry)
+		}
+	}
+	return out
+}
+
+type snapshotEntry struct {
+	snapshotVersion
+	History []snapshotVersion `json:"history,omitempty"`
+}
+
+type snapshotVersion struct {
+	VersionID   string          `json:"versionId"`
+	LastUpdated string          `json:"lastUpdated"`
+	Deleted     bool            `json:"deleted,omitempty"`
+	Method      string          `json:"method,omitempty"`
+	Resource    json.RawMessage `json:"resource,omitempty"`
+}
+
+type snapshotFile struct {
+	Sequence  uint64                              `json:"sequence,omitempty"`
+	Resources map[string]map[string]snapshotEntry `json:"resources"`
+}
+
+func EncodeState(state *State) ([]byte, error) {
+	file := snapshotFile{Sequence: state.sequence, Resources: map[string]map[string]snapshotEntry{}}
+	for resourceType, items := range state.resources {
+		file.Resources[resourceType] = make(map[string]snapshotEntry, len(items))
+		for id, entry := range items {
+			encoded, err := encodeSnapshotEntry(entry)
+			if err != nil {
+				return nil, err
+			}
+			file.Resources[resourceType][id] = encoded
+		}
+	}
+	return json.Marshal(file)
+}
+
+func DecodeState(data []byte, registry *dstu3.Registry) (*State, error) {
+	var file snapshotFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, err
+	}
+	state := &State{resources: map[string]map[string]*ResourceEntry{}, sequence: file.Sequence}
+	for resourceType, items := range file.Resources {
+		state.resources[resourceType] = make(map[string]*ResourceEntry, len(items))
+		for id, item := range items {
+			entry, err := decodeSnapshotEntry(registry, resourceType, id, item)
+			if err != nil {
+				return nil, fmt.Errorf("%s/%s: %w", resourceType, id, err)
+			}
+			state.resources[resourceType][id] = entry
+		}
+	}
+	return state, nil
+}
+
+func writeStateFile(path string, state *State) error {
+	data, err := EncodeState(state)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	// Sync before the rename so a crash cannot leave an empty or partial
+	// file under the final name.
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func encodeSnapshotEntry(entry *ResourceEntry) (snapshotEntry, error) {
+	current, err := encodeSnapshotVersion(currentVersion("", "", entry))
+	if err != nil {
+		return snapshotEntry{}, err
+	}
+	out := snapshotEntry{snapshotVersion: current}
+	for _, item := range entry.History {
+		version, err := encodeSnapshotVersion(item)
+		if err != nil {
+			return snapshotEntry{}, err
+		}
+		out.History = append(out.History, version)
+	}
+	return out, nil
+}
+
+func encodeSnapshotVersion(version *ResourceVersion) (snapshotVersion, error) {
+	out := snapshotVersion{VersionID: version.VersionID, LastUpdated: version.LastUpdated, Deleted: version.Deleted, Method: version.Method}
+	if version.Resource == nil {
+		return out, nil
+	}
+	data, err := json.Marshal(version.Resource)
+	if err != nil {
+		return snapshotVersion{}, err
+	}
+	out.Resource = data
+	return out, nil
+}
+
+func decodeSnapshotEntry(registry *dstu3.Registry, resourceType, id string, item snapshotEntry) (*ResourceEntry, error) {
+	current, err := decodeSnapshotVersion(registry, resourceType, id, item.snapshotVersion)
+	if err != nil {
+		return nil, err
+	}
+	entry := &ResourceEntry{
+		Resource:    current.Resource,
+		VersionID:   current.VersionID,
+		LastUpdated: current.LastUpdated,
+		Deleted:     current.Deleted,
+		Method:      current.Method,
+	}
+	for _, raw := range item.History {
+		past, err := decodeSnapshotVersion(registry, resourceType, id, raw)
+		if err != nil {
+			return nil, err
+		}
+		entry.History = append(entry.History, past)
+	}
+	return entry, nil
+}
+
+func decodeSnapshotVersion(registry *dstu3.Registry, resourceType, id string, item snapshotVersion) (*ResourceVersion, error) {
+	version := &ResourceVersion{
+		ResourceType: resourceType,
+		ID:           id,
+		VersionID:    item.VersionID,
+		LastUpdated:  item.LastUpdated,
+		Deleted:      item.Deleted,
+		Method:       item.Method,
+	}
+	if item.Deleted {
+		return version, nil
+	}
+	resource, err := registry.DecodeResource(item.Resource)
+	if err != nil {
+		return nil, err
+	}
+	version.Resource = resource
+	return version, nil
+}
@@ -1,33 +1,93 @@
 package store
 
 import (
+	"errors"
 	"fmt"
 	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"mini-fhir/internal/fhir/dstu3"
 )
 
+var (
+	ErrNotFound = errors.New("resource not found")
+	ErrGone     = errors.New("resource deleted")
+	ErrExists   = errors.New("resource already exists")
+	ErrConflict = errors.New("version conflict")
+)
+
+// AnyVersion as an expected version, from "If-Match: *", matches any
+// current version of a resource that exists and is not deleted.
+const AnyVersion = "*"
+
+// Methods record the interaction that wrote a version.
+const (
+	MethodCreate = "POST"
+	MethodUpdate = "PUT"
+	MethodDelete = "DELETE"
+)
+
 type ResourceEntry struct {
 	Resource    dstu3.Resource
 	VersionID   string
 	LastUpdated string
-	History     []dstu3.Resource
+	Deleted     bool
+	Method      string
+	History     []*ResourceVersion
 }
 
-type Store struct {
+// ResourceVersion is one historical version of a resource. Tombstones have
+// Deleted set and no Resource. Method is empty for versions written before
+// it was recorded.
+type ResourceVersion struct {
+	ResourceType string
+	ID           string
+	VersionID    string
+	LastUpdated  string
+	Deleted      bool
+	Method       string
+	Resource     dstu3.Resource
+}
+
+type Store interface {
+	Create(resource dstu3.Resource) (*ResourceEntry, error)
+	Update(resource dstu3.Resource, expectedVersion string) (*ResourceEntry, error)
+	Delete(resourceType, id, expectedVersion string) error
+	Get(resourceType, id string) (*ResourceEntry, error)
+	List(resourceType string) ([]*ResourceEntry, error)
+	History(resourceType, id string) ([]*ResourceVersion, error)
+	Version(resourceType, id, versionID string) (*ResourceVersion, error)
+	TypeHistory(resourceType string) []*ResourceVersion
+	SystemHistory() []*ResourceVersion
+	Dump() *State
+	Restore(state *State) error
+}
+
+type MemoryStore struct {
 	mu        sync.RWMutex
 	resources map[string]map[string]*ResourceEntry
+	clock     Clock
+	last      time.Time
 }
 
-func NewStore() *Store {
-	return &Store{
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
 		resources: map[string]map[string]*ResourceEntry{},
+		clock:     systemClock{},
 	}
 }
 
-func (s *Store) Create(resource dstu3.Resource) (*ResourceEntry, error) {
+func (s *MemoryStore) SetClock(clock Clock) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.clock = clock
+}
+
+func (s *MemoryStore) Create(resource dstu3.Resource) (*ResourceEntry, error) {
 	if resource == nil {
 		return nil, fmt.Errorf("resource is nil")
 	}
@@ -42,16 +102,19 @@ func (s *Store) Create(resource dstu3.Resource) (*ResourceEntry, error) {
 	if _, ok := s.resources[resourceType]; !ok {
 		s.resources[resourceType] = map[string]*ResourceEntry{}
 	}
+	// A deleted id is still taken: creating it would extend the deleted
+	// resource's history rather than start a new resource.
 	if _, exists := s.resources[resourceType][resource.GetID()]; exists {
-		return nil, fmt.Errorf("resource already exists")
+		return nil, ErrExists
 	}
 
-	entry := newEntry(resource, "1")
-	s.resources[resourceType][resource.GetID()] = entry
-	return cloneEntry(entry), nil
+	return cloneEntry(s.write(cloneResource(resource), MethodCreate)), nil
 }
 
-func (s *Store) Update(resource dstu3.Resource) (*ResourceEntry, error) {
+// Update writes the next version of resource. A non-empty expectedVersion
+// must match the current version, or be AnyVersion, or ErrConflict is
+// returned.
+func (s *MemoryStore) Update(resource dstu3.Resource, expectedVersion string) (*ResourceEntry, error) {
 	if resource == nil {
 		return nil, fmt.Errorf("resource is nil")
 	}
@@ -66,42 +129,21 @@ func (s *Store) Update(resource dstu3.Resource) (*ResourceEntry, error) {
 	if _, ok := s.resources[resourceType]; !ok {
 		s.resources[resourceType] = map[string]*ResourceEntry{}
 	}
-
-	entry, exists := s.resources[resourceType][resource.GetID()]
-	if !exists {
-		entry = newEntry(resource, "1")
-		s.resources[resourceType][resource.GetID()] = entry
-		return cloneEntry(entry), nil
+	if expectedVersion != "" {
+		entry, exists := s.resources[resourceType][resource.GetID()]
+		if !exists || entry.Deleted || !matchesVersion(entry, expectedVersion) {
+			return nil, ErrConflict
+		}
 	}
-
-	entry.History = append(entry.History, entry.Resource)
-	nextVersion := fmt.Sprintf("%d", len(entry.History)+1)
-	entry.Resource = resource
-	entry.VersionID = nextVersion
-	entry.LastUpdated = time.Now().UTC().Format(time.RFC3339)
-	applyMeta(entry)
-	return cloneEntry(entry), nil
+	return cloneEntry(s.write(cloneResource(resource), MethodUpdate)), nil
 }
 
-func (s *Store) Delete(resourceType, id string) error {
-	if resourceType == "" || id == "" {
-		return fmt.Errorf("resource type and id are required")
-	}
-
-	s.mu.Lock()
-	defer s.mu.Unlock()
-
-	if _, ok := s.resources[resourceType]; !ok {
-		return fmt.Errorf("resource not found")
-	}
-	if _, ok := s.resources[resourceType][id]; !ok {
-		return fmt.Errorf("resource not found")
-	}
-	delete(s.resources[resourceType], id)
-	return nil
+func (s *MemoryStore) Delete(resourceType, id, expectedVersion string) error {
+	_, err := s.delete(resourceType, id, expectedVersion)
+	return err
 }
 
-func (s *Store) Get(resourceType, id string) (*ResourceEntry, error) {
+func (s *MemoryStore) Get(resourceType, id string) (*ResourceEntry, error) {
 	if resourceType == "" || id == "" {
 		return nil, fmt.Errorf("resource type and id are required")
 	}
@@ -111,12 +153,15 @@ func (s *Store) Get(resourceType, id string) (*ResourceEntry, error) {
 
 	entry, ok := s.resources[resourceType][id]
 	if !ok {
-		return nil, fmt.Errorf("resource not found")
+		return nil, ErrNotFound
+	}
+	if entry.Deleted {
+		return nil, ErrGone
 	}
 	return cloneEntry(entry), nil
 }
 
-func (s *Store) List(resourceType string) ([]*ResourceEntry, error) {
+func (s *MemoryStore) List(resourceType string) ([]*ResourceEntry, error) {
 	if resourceType == "" {
 		return nil, fmt.Errorf("resource type is required")
 	}
@@ -129,7 +174,10 @@ func (s *Store) List(resourceType string) ([]*ResourceEntry, error) {
 		return nil, nil
 	}
 	ids := make([]string, 0, len(entries))
-	for id := range entries {
+	for id, entry := range entries {
+		if entry.Deleted {
+			continue
+		}
 		ids = append(ids, id)
 	}
 	sort.Strings(ids)
@@ -140,58 +188,323 @@ func (s *Store) List(resourceType string) ([]*ResourceEntry, error) {
 	return result, nil
 }
 
-func (s *Store) History(resourceType, id string) ([]dstu3.Resource, error) {
-	entry, err := s.Get(resourceType, id)
+// History returns every version of a resource, including tombstones,
+// newest first.
+func (s *MemoryStore) History(resourceType, id string) ([]*ResourceVersion, error) {
+	if resourceType == "" || id == "" {
+		return nil, fmt.Errorf("resource type and id are required")
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	entry, ok := s.resources[resourceType][id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	versions := make([]*ResourceVersion, 0, len(entry.History)+1)
+	versions = append(versions, cloneVersion(currentVersion(resourceType, id, entry)))
+	for i := len(entry.History) - 1; i >= 0; i-- {
+		versions = append(versions, cloneVersion(entry.History[i]))
+	}
+	return versions, nil
+}
+
+func (s *MemoryStore) Version(resourceType, id, versionID string) (*ResourceVersion, error) {
+	if versionID == "" {
+		return nil, fmt.Errorf("version id is required")
+	}
+	versions, err := s.History(resourceType, id)
 	if err != nil {
 		return nil, err
 	}
-	return entry.History, nil
+	for _, version := range versions {
+		if version.VersionID == versionID {
+			return version, nil
+		}
+	}
+	return nil, fmt.Errorf("version %s not found", versionID)
+}
+
+// TypeHistory returns every version of every resource of resourceType,
+// newest first.
+func (s *MemoryStore) TypeHistory(resourceType string) []*ResourceVersion {
+	if resourceType == "" {
+		return nil
+	}
+	return s.versions(resourceType)
+}
+
+// SystemHistory returns every version of every resource, newest first.
+func (s *MemoryStore) SystemHistory() []*ResourceVersion {
+	return s.versions("")
 }
 
-func (s *Store) SystemHistory() []dstu3.Resource {
+func (s *MemoryStore) versions(resourceType string) []*ResourceVersion {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
-	result := []dstu3.Resource{}
-	for _, items := range s.resources {
-		for _, entry := range items {
-			result = append(result, entry.Resource)
+	result := []*ResourceVersion{}
+	for itemType, items := range s.resources {
+		if resourceType != "" && itemType != resourceType {
+			continue
+		}
+		for id, entry := range items {
+			for _, version := range entry.History {
+				result = append(result, cloneVersion(version))
+			}
+			result = append(result, cloneVersion(currentVersion(itemType, id, entry)))
 		}
 	}
+	sortVersions(result)
 	return result
 }
 
+func (s *MemoryStore) Dump() *State {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return &State{resources: cloneResources(s.resources)}
+}
+
+// Restore atomically replaces the store contents with state.
+func (s *MemoryStore) Restore(state *State) error {
+	if state == nil {
+		return fmt.Errorf("state is nil")
+	}
+	resources := cloneResources(state.resources)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.resources = resources
+	for _, items := range resources {
+		for _, entry := range items {
+			s.observe(entry.LastUpdated)
+		}
+	}
+	return nil
+}
+
+// putVersion applies a replayed version. Versions not newer than the
+// entry's current one are already applied and are skipped.
+func (s *MemoryStore) putVersion(version *ResourceVersion) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.resources[version.ResourceType]; !ok {
+		s.resources[version.ResourceType] = map[string]*ResourceEntry{}
+	}
+	entry, exists := s.resources[version.ResourceType][version.ID]
+	if exists && versionNumber(version.VersionID) <= versionNumber(entry.VersionID) {
+		return
+	}
+	if !exists {
+		entry = &ResourceEntry{}
+		s.resources[version.ResourceType][version.ID] = entry
+	} else {
+		entry.History = append(entry.History, currentVersion(version.ResourceType, version.ID, entry))
+	}
+	entry.Resource = version.Resource
+	entry.Deleted = version.Deleted
+	entry.Method = version.Method
+	entry.VersionID = version.VersionID
+	entry.LastUpdated = version.LastUpdated
+	s.observe(version.LastUpdated)
+	if !entry.Deleted {
+		applyMeta(entry)
+	}
+}
+
+// entry returns a copy of the entry for resourceType/id, or nil when there
+// is none.
+func (s *MemoryStore) entry(resourceType, id string) *ResourceEntry {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	entry, ok := s.resources[resourceType][id]
+	if !ok {
+		return nil
+	}
+	return cloneEntry(entry)
+}
+
+// setEntry puts back an entry captured by entry, removing it when nil.
+func (s *MemoryStore) setEntry(resourceType, id string, entry *ResourceEntry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if entry == nil {
+		delete(s.resources[resourceType], id)
+		return
+	}
+	if _, ok := s.resources[resourceType]; !ok {
+		s.resources[resourceType] = map[string]*ResourceEntry{}
+	}
+	s.resources[resourceType][id] = entry
+}
+
+// delete records a tombstone version and returns it, or nil when the
+// resource was already deleted.
+func (s *MemoryStore) delete(resourceType, id, expectedVersion string) (*ResourceVersion, error) {
+	if resourceType == "" || id == "" {
+		return nil, fmt.Errorf("resource type and id are required")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, ok := s.resources[resourceType][id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	if expectedVersion != "" && (!matchesVersion(entry, expectedVersion) || expectedVersion == AnyVersion && entry.Deleted) {
+		return nil, ErrConflict
+	}
+	if entry.Deleted {
+		return nil, nil
+	}
+	entry.History = append(entry.History, currentVersion(resourceType, id, entry))
+	entry.Resource = nil
+	entry.Deleted = true
+	entry.Method = MethodDelete
+	entry.VersionID = fmt.Sprintf("%d", len(entry.History)+1)
+	entry.LastUpdated = s.stamp()
+	return cloneVersion(currentVersion(resourceType, id, entry)), nil
+}
+
+// write stores resource as the next version of its entry, reviving
+// tombstoned entries. The caller must hold the write lock.
+func (s *MemoryStore) write(resource dstu3.Resource, method string) *ResourceEntry {
+	resourceType := resource.GetResourceType()
+	entry, exists := s.resources[resourceType][resource.GetID()]
+	if !exists {
+		entry = newEntry(resource, "1", s.stamp())
+		entry.Method = method
+		s.resources[resourceType][resource.GetID()] = entry
+		return entry
+	}
+
+	entry.History = append(entry.History, currentVersion(resourceType, resource.GetID(), entry))
+	entry.Resource = resource
+	entry.Deleted = false
+	entry.Method = method
+	entry.VersionID = fmt.Sprintf("%d", len(entry.History)+1)
+	entry.LastUpdated = s.stamp()
+	applyMeta(entry)
+	return entry
+}
+
+// stamp returns the next lastUpdated value. Timestamps are strictly
+// increasing even when the clock is frozen or moved backwards, so writes
+// never tie on _lastUpdated. The caller must hold the write lock.
+func (s *MemoryStore) stamp() string {
+	now := s.clock.Now().UTC().Truncate(time.Microsecond)
+	if !now.After(s.last) {
+		now = s.last.Add(time.Microsecond)
+	}
+	s.last = now
+	return now.Format(timestampLayout)
+}
+
+// observe advances the stamp floor past an existing lastUpdated value.
+// The caller must hold the write lock.
+func (s *MemoryStore) observe(lastUpdated string) {
+	if parsed, err := time.Parse(time.RFC3339Nano, lastUpdated); err == nil && parsed.After(s.last) {
+		s.last = parsed
+	}
+}
+
+// sortVersions orders versions newest first, breaking ties on resource
+// type, id and descending version number so output is deterministic.
+func sortVersions(versions []*ResourceVersion) {
+	sort.SliceStable(versions, func(i, j int) bool {
+		left, right := versions[i], versions[j]
+		if cmp := compareInstants(left.LastUpdated, right.LastUpdated); cmp != 0 {
+			return cmp > 0
+		}
+		if left.ResourceType != right.ResourceType {
+			return left.ResourceType < right.ResourceType
+		}
+		if left.ID != right.ID {
+			return left.ID < right.ID
+		}
+		return versionNumber(left.VersionID) > versionNumber(right.VersionID)
+	})
+}
+
+func compareInstants(left, right string) int {
+	leftTime, leftErr := time.Parse(time.RFC3339Nano, left)
+	rightTime, rightErr := time.Parse(time.RFC3339Nano, right)
+	if leftErr != nil || rightErr != nil {
+		return strings.Compare(left, right)
+	}
+	return leftTime.Compare(rightTime)
+}
+
+func matchesVersion(entry *ResourceEntry, expectedVersion string) bool {
+	return expectedVersion == AnyVersion || entry.VersionID == expectedVersion
+}
+
+func versionNumber(versionID string) int {
+	n, err := strconv.Atoi(versionID)
+	if err != nil {
+		return 0
+	}
+	return n
+}
+
+func currentVersion(resourceType, id string, entry *ResourceEntry) *ResourceVersion {
+	return &ResourceVersion{
+		ResourceType: resourceType,
+		ID:           id,
+		VersionID:    entry.VersionID,
+		LastUpdated:  entry.LastUpdated,
+		Deleted:      entry.Deleted,
+		Method:       entry.Method,
+		Resource:     entry.Resource,
+	}
+}
+
 func cloneEntry(entry *ResourceEntry) *ResourceEntry {
 	clone := &ResourceEntry{
 		VersionID:   entry.VersionID,
 		LastUpdated: entry.LastUpdated,
-		History:     make([]dstu3.Resource, 0, len(entry.History)),
+		Deleted:     entry.Deleted,
+		Method:      entry.Method,
+		History:     make([]*ResourceVersion, 0, len(entry.History)),
 	}
 	if entry.Resource != nil {
-		res, err := entry.Resource.Clone()
-		if err == nil {
-			clone.Resource = res
-		} else {
-			clone.Resource = entry.Resource
-		}
+		clone.Resource = cloneResource(entry.Resource)
 	}
 	for _, item := range entry.History {
-		res, err := item.Clone()
-		if err == nil {
-			clone.History = append(clone.History, res)
-		} else {
-			clone.History = append(clone.History, item)
-		}
+		clone.History = append(clone.History, cloneVersion(item))
 	}
 	return clone
 }
 
-func newEntry(resource dstu3.Resource, version string) *ResourceEntry {
+func cloneVersion(version *ResourceVersion) *ResourceVersion {
+	clone := *version
+	if version.Resource != nil {
+		clone.Resource = cloneResource(version.Resource)
+	}
+	return &clone
+}
+
+func cloneResource(resource dstu3.Resource) dstu3.Resource {
+	res, err := resource.Clone()
+	if err != nil || res == nil {
+		return resource
+	}
+	return res
+}
+
+func newEntry(resource dstu3.Resource, version string, lastUpdated string) *ResourceEntry {
 	entry := &ResourceEntry{
-		Resource:  resource,
-		VersionID: version,
+		Resource:    resource,
+		VersionID:   version,
+		LastUpdated: lastUpdated,
 	}
-	entry.LastUpdated = time.Now().UTC().Format(time.RFC3339)
 	applyMeta(entry)
 	return entry
 }
@@ -2,10 +2,12 @@ package validation
 
 import (
 	"context"
+	"embed"
 	"encoding/json"
 	"fmt"
 	"net/http"
 	"os"
+	"path"
 	"path/filepath"
 	"sort"
 	"strings"
@@ -28,6 +30,9 @@ type cacheEnvelope struct {
 
 const CacheVersion = 1 // Bump to invalidate cached rule sets
 
+//go:embed profiles/*.json
+var embeddedProfiles embed.FS
+
 func NewProfileStore(cacheDir string, cacheTTL time.Duration, version int) *ProfileStore {
 	if version <= 0 {
 		version = CacheVersion
@@ -45,9 +50,41 @@ func (p *ProfileStore) Get(profileURL string) (*RuleSet, bool) {
 }
 
 func (p *ProfileStore) LoadDefaults(ctx context.Context, registry *dstu3.Registry) error {
+	for _, info := range profileSources(registry) {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		rules, err := loadEmbeddedProfile(info.ProfileSource)
+		if err != nil {
+			return fmt.Errorf("load embedded profile %s: %w", info.ProfileSource, err)
+		}
+		p.Add(info.ProfileSource, rules)
+	}
+	return nil
+}
+
+// LoadRemote replaces the loaded profiles with ones fetched from their
+// sources. Nothing is replaced unless every fetch succeeds.
+func (p *ProfileStore) LoadRemote(ctx context.Context, registry *dstu3.Registry) error {
 	client := defaultHTTPClient()
+	fetched := map[string]*RuleSet{}
+	for _, info := range profileSources(registry) {
+		rules, err := p.loadProfileRules(ctx, client, info.ProfileSource)
+		if err != nil {
+			return fmt.Errorf("load profile %s: %w", info.ProfileSource, err)
+		}
+		fetched[info.ProfileSource] = rules
+	}
+	for profileURL, rules := range fetched {
+		p.Add(profileURL, rules)
+	}
+	return nil
+}
+
+func profileSources(registry *dstu3.Registry) []dstu3.ResourceInfo {
 	resourceTypes := registry.ResourceTypes()
 	sort.Strings(resourceTypes)
+	sources := make([]dstu3.ResourceInfo, 0, len(resourceTypes))
 	for _, resourceType := range resourceTypes {
 		info, ok := registry.Info(resourceType)
 		if !ok {
@@ -56,13 +93,17 @@ func (p *ProfileStore) LoadDefaults(ctx context.Context, registry *dstu3.Registr
 		if info.ProfileSource == "" {
 			continue
 		}
-		rules, err := p.loadProfileRules(ctx, client, info.ProfileSource)
-		if err != nil {
-			return fmt.Errorf("load profile %s: %w", info.ProfileSource, err)
-		}
-		p.Add(info.ProfileSource, rules)
+		sources = append(sources, info)
 	}
-	return nil
+	return sources
+}
+
+func loadEmbeddedProfile(profileURL string) (*RuleSet, error) {
+	data, err := embeddedProfiles.ReadFile(path.Join("profiles", path.Base(profileURL)))
+	if err != nil {
+		return nil, err
+	}
+	return parseProfile(data)
 }
 
 func (p *ProfileStore) loadProfileRules(ctx context.Context, client *http.Client, profileURL string) (*RuleSet, error) {
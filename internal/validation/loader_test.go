@@ -6,6 +6,8 @@ import (
 	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 	"testing"
 	"time"
 
@@ -62,7 +64,44 @@ func TestProfileCacheTTLInvalidation(t *testing.T) {
 func TestProfileStoreLoadDefaults(t *testing.T) {
 	registry := dstu3.NewRegistry()
 	store := NewProfileStore(t.TempDir(), 0, CacheVersion)
-	if err := store.LoadDefaults(context.Background(), registry); err == nil {
-		t.Fatalf("expected failure without reachable profile sources")
+	if err := store.LoadDefaults(context.Background(), registry); err != nil {
+		t.Fatalf("expected embedded profiles to load offline: %v", err)
+	}
+	for _, resourceType := range registry.ResourceTypes() {
+		info, _ := registry.Info(resourceType)
+		if info.ProfileSource == "" {
+			continue
+		}
+		rules, ok := store.Get(info.ProfileSource)
+		if !ok || rules.ResourceType != resourceType {
+			t.Fatalf("expected embedded rules for %s", resourceType)
+		}
+	}
+	flag, _ := store.Get("https://hl7.org/fhir/STU3/flag.profile.json")
+	sort.Strings(flag.RequiredPaths)
+	if strings.Join(flag.RequiredPaths, ",") != "code,status,subject" {
+		t.Fatalf("unexpected Flag required paths: %v", flag.RequiredPaths)
+	}
+}
+
+func TestProfileStoreLoadRemoteKeepsProfilesOnFailure(t *testing.T) {
+	registry := dstu3.NewRegistry()
+	tmp := t.TempDir()
+	store := NewProfileStore(tmp, 0, CacheVersion)
+	if err := store.LoadDefaults(context.Background(), registry); err != nil {
+		t.Fatalf("load defaults failed: %v", err)
+	}
+	// The first profile comes from the cache; fetching the next one fails.
+	first := profileSources(registry)[0].ProfileSource
+	if err := store.writeCache(first, &RuleSet{ResourceType: "Consent", RequiredPaths: []string{"cached"}}); err != nil {
+		t.Fatalf("write cache failed: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := store.LoadRemote(ctx, registry); err == nil {
+		t.Fatalf("expected remote load to fail")
+	}
+	if rules, _ := store.Get(first); len(rules.RequiredPaths) == 1 && rules.RequiredPaths[0] == "cached" {
+		t.Fatalf("expected a failed remote load to leave the embedded profiles in place")
 	}
 }
@@ -52,6 +52,10 @@ func loadProfile(ctx context.Context, client *http.Client, profileURL string) (*
 	if err != nil {
 		return nil, err
 	}
+	return parseProfile(body)
+}
+
+func parseProfile(body []byte) (*RuleSet, error) {
 	var profile structureDefinition
 	if err := json.Unmarshal(body, &profile); err != nil {
 		return nil, err
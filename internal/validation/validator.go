@@ -10,10 +10,17 @@ import (
 type Validator struct {
 	registry *dstu3.Registry
 	profiles *ProfileStore
+	checks   map[string]func(dstu3.Resource) error
 }
 
 func NewValidator(registry *dstu3.Registry, profiles *ProfileStore) *Validator {
-	return &Validator{registry: registry, profiles: profiles}
+	return &Validator{registry: registry, profiles: profiles, checks: map[string]func(dstu3.Resource) error{}}
+}
+
+// AddCheck runs check on every resource of resourceType once its profile
+// rules pass. Checks are registered at startup, before serving.
+func (v *Validator) AddCheck(resourceType string, check func(dstu3.Resource) error) {
+	v.checks[resourceType] = check
 }
 
 func (v *Validator) Validate(resource dstu3.Resource, profile string) *OperationOutcome {
@@ -43,6 +50,11 @@ func (v *Validator) Validate(resource dstu3.Resource, profile string) *Operation
 	if err := v.applyBaseProfile(resource); err != nil {
 		return NewOutcomeIssue("error", "invalid", err.Error())
 	}
+	if check, ok := v.checks[resourceType]; ok {
+		if err := check(resource); err != nil {
+			return NewOutcomeIssue("error", "invalid", err.Error())
+		}
+	}
 	return nil
 }
 